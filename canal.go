@@ -1,11 +1,14 @@
 package canal
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/katakurin/canal/protobuf/protocol"
@@ -16,17 +19,47 @@ import (
 var (
 	ErrUnsupportedVersion = errors.New("unsupported version at this client")
 	ErrExpectHandshake    = errors.New("expect handshake but found other type")
-	ErrUnexpectedPacket   = errors.New("unexpected packet type when ack is expected")
+	ErrUnexpectedPacket   = errors.New("unexpected packet type")
+	ErrClientClosed       = errors.New("client is disconnected")
+	ErrConnectionBroken   = errors.New("connection is broken")
 )
 
 type Client struct {
+	mu             sync.Mutex // serializes exchanges with the server
+	wmu            sync.Mutex // serializes writes on netConn
+	hb             *heartbeat
+	log            Logger
 	opts           clientOptions
-	addr           string // host:port address.
-	netConn        net.Conn
-	connected      uint32
+	addr           string   // host:port address.
+	netConn        net.Conn // replaced holding both mu and wmu
+	state          uint32   // connection state, accessed atomically
+	subscribed     bool
+	positioned     bool
 	clientIdentity clientIdentity
+	compression    int32 // protocol.Compression, accessed atomically
+	rtt            int64 // time.Duration, accessed atomically
+
+	deadlineMu  sync.Mutex
+	ctxDeadline time.Time
+	interrupted bool
+
+	// Guarded by wmu, with WithRollbackOnConnect only: the batches fetched on
+	// netConn and not acked yet, and the range of the batch IDs rolled back
+	// when reconnecting, empty while staleHi is zero.
+	batches          map[int64]struct{}
+	staleLo, staleHi int64
 }
 
+// Connection states of a Client. An exchange interrupted or failed halfway
+// leaves the stream out of sync: the connection is then broken, and redialed
+// on the next call when reconnecting is enabled.
+const (
+	stateDisconnected uint32 = iota
+	stateConnected
+	stateBroken
+	stateClosed
+)
+
 type clientIdentity struct {
 	destination string
 	clientId    int
@@ -34,53 +67,288 @@ type clientIdentity struct {
 }
 
 func NewClient(addr, destination string, opts ...ClientOption) (*Client, error) {
+	return NewClientContext(context.Background(), addr, destination, opts...)
+}
+
+// NewClientContext is like NewClient but gives up dialing and handshaking
+// once ctx is done.
+func NewClientContext(ctx context.Context, addr, destination string, opts ...ClientOption) (*Client, error) {
 	cc := &Client{
-		opts: defaultClientOptions(),
-		addr: addr,
+		opts:    defaultClientOptions(),
+		addr:    addr,
+		batches: make(map[int64]struct{}),
 	}
 
 	for _, opt := range opts {
 		opt.apply(&cc.opts)
 	}
 	cc.clientIdentity = clientIdentity{
-		clientId:    1001,
+		clientId:    cc.opts.clientID,
 		destination: destination,
 	}
+	cc.log = withFields(cc.opts.logger, F("destination", destination), F("clientId", cc.opts.clientID))
 
-	if err := cc.connect(); err != nil {
+	if err := cc.connect(ctx); err != nil {
 		return nil, err
 	}
 
-	if err := cc.handshake(); err != nil {
+	end := cc.bindContext(ctx)
+	if err := end(cc.handshake()); err != nil {
+		_ = cc.netConn.Close()
 		return nil, err
 	}
+	cc.setState(stateConnected)
+	cc.startHeartbeat()
+	cc.log.Info("connected to canal server", F("addr", addr), F("compression", cc.Compression().String()))
 
 	return cc, nil
 }
 
-func (c *Client) connect() error {
-	conn, err := net.DialTimeout("tcp", c.addr, c.opts.dialTimeout)
+func (c *Client) connect(ctx context.Context) error {
+	if c.opts.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.dialTimeout)
+		defer cancel()
+	}
+	dialer := c.opts.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
 	if err != nil {
-		return err
+		return &OpError{Op: "dial", Addr: c.addr, Err: err}
 	}
 
+	c.wmu.Lock()
 	c.netConn = conn
+	c.wmu.Unlock()
+	if c.hb != nil {
+		c.hb.setConn(conn)
+	}
+	return nil
+}
+
+// lock serializes exchanges with the server. wait is how long the server may
+// legitimately keep the exchange pending, so heartbeats do not mistake a long
+// poll for a dead connection.
+func (c *Client) lock(wait time.Duration) {
+	c.mu.Lock()
+	if c.hb != nil {
+		c.hb.enter(wait)
+	}
+}
+
+func (c *Client) unlock() {
+	if c.hb != nil {
+		c.hb.leave()
+	}
+	c.mu.Unlock()
+}
+
+// aLongTimeAgo is a deadline in the past, used to unblock pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// bindContext maps ctx onto the connection deadlines for the duration of one
+// exchange. The returned function must be called with the outcome of the
+// exchange; it releases ctx and turns an interruption into ctx.Err(). An
+// interrupted exchange leaves the stream out of sync, so the connection is
+// marked broken: the next call redials it, or fails with ErrConnectionBroken
+// without a reconnect policy.
+func (c *Client) bindContext(ctx context.Context) func(error) error {
+	conn := c.netConn
+	deadline, _ := ctx.Deadline()
+	c.deadlineMu.Lock()
+	c.ctxDeadline = deadline
+	c.interrupted = false
+	c.deadlineMu.Unlock()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	if ctx.Done() == nil {
+		close(stopped)
+	} else {
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				c.deadlineMu.Lock()
+				c.interrupted = true
+				_ = conn.SetDeadline(aLongTimeAgo)
+				c.deadlineMu.Unlock()
+			case <-done:
+			}
+		}()
+	}
+
+	return func(err error) error {
+		close(done)
+		<-stopped
+		c.deadlineMu.Lock()
+		c.ctxDeadline = time.Time{}
+		c.interrupted = false
+		_ = conn.SetDeadline(time.Time{})
+		c.deadlineMu.Unlock()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			c.markBroken()
+			return ctx.Err()
+		}
+		// The connection deadline may expire just before ctx notices its own.
+		if !deadline.IsZero() && !time.Now().Before(deadline) && isTimeout(err) {
+			c.markBroken()
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ensureConnected re-establishes a broken connection when reconnecting is
+// enabled. Without a reconnect policy a broken client fails every call with
+// ErrConnectionBroken, rather than reading replies meant for earlier ones.
+func (c *Client) ensureConnected(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch c.getState() {
+	case stateClosed:
+		return ErrClientClosed
+	case stateBroken:
+	default:
+		return nil
+	}
+	if c.opts.reconnect == nil {
+		return ErrConnectionBroken
+	}
+	return c.reconnect(ctx)
+}
+
+// reconnect redials the server with backoff, then redoes the handshake and
+// restores the subscription so that the caller can carry on as before.
+func (c *Client) reconnect(ctx context.Context) error {
+	c.log.Warn("connection broken, reconnecting", F("addr", c.addr))
+	_ = c.netConn.Close()
+
+	var err error
+	for attempt := 0; c.opts.reconnect.MaxRetries <= 0 || attempt < c.opts.reconnect.MaxRetries; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(c.opts.reconnect.delay(attempt - 1))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if err = c.redial(ctx); err == nil {
+			c.log.Info("reconnected to canal server", F("addr", c.addr), F("attempt", attempt+1))
+			return nil
+		}
+		c.log.Warn("reconnect failed", F("addr", c.addr), F("attempt", attempt+1), F("error", err))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (c *Client) redial(ctx context.Context) error {
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+	end := c.bindContext(ctx)
+	if err := end(c.restore()); err != nil {
+		_ = c.netConn.Close()
+		return err
+	}
+	c.setState(stateConnected)
 	return nil
 }
 
+func (c *Client) restore() error {
+	if err := c.handshake(); err != nil {
+		return err
+	}
+
+	if c.subscribed {
+		if err := c.subscribe(c.clientIdentity.filter); err != nil {
+			return err
+		}
+		if c.opts.rollbackOnConnect {
+			if err := c.rollback(0); err != nil {
+				return err
+			}
+			// Acks of the batches fetched before are stale now. Only their
+			// range is kept, so that batches given up on do not pile up.
+			c.wmu.Lock()
+			for id := range c.batches {
+				if c.staleHi == 0 || id < c.staleLo {
+					c.staleLo = id
+				}
+				if id > c.staleHi {
+					c.staleHi = id
+				}
+				delete(c.batches, id)
+			}
+			c.wmu.Unlock()
+		}
+	}
+	return nil
+}
+
+// Compression returns the compression the server announced during the
+// handshake. MESSAGES packets compressed with it are decoded transparently.
+func (c *Client) Compression() protocol.Compression {
+	return protocol.Compression(atomic.LoadInt32(&c.compression))
+}
+
+// Connected reports whether the client is connected and its connection in
+// a usable state.
+func (c *Client) Connected() bool {
+	return c.getState() == stateConnected
+}
+
+func (c *Client) getState() uint32 {
+	return atomic.LoadUint32(&c.state)
+}
+
+func (c *Client) setState(state uint32) {
+	atomic.StoreUint32(&c.state, state)
+}
+
+// markBroken records that the stream is out of sync, unless the client was
+// closed meanwhile.
+func (c *Client) markBroken() {
+	atomic.CompareAndSwapUint32(&c.state, stateConnected, stateBroken)
+}
+
 func (c *Client) Disconnect() error {
+	c.lock(0)
+	defer c.unlock()
 	return c.disconnect()
 }
 
 func (c *Client) disconnect() error {
-	if c.opts.rollbackOnDisConnect && c.connected == 1 {
-		if err := c.Rollback(0); err != nil {
-			return err
-		}
+	if c.getState() == stateClosed {
+		return nil
+	}
+	c.stopHeartbeat()
+	// The client is closed even when the rollback fails, its error is only
+	// reported afterwards.
+	var err error
+	if c.opts.rollbackOnDisConnect && c.getState() == stateConnected && c.subscribed {
+		err = c.rollback(0)
 	}
+	c.setState(stateClosed)
 	_ = c.netConn.Close()
-	c.connected = 0
-	return nil
+	c.log.Info("disconnected from canal server", F("addr", c.addr))
+	return err
 }
 
 func (c *Client) handshake() error {
@@ -97,47 +365,73 @@ func (c *Client) handshake() error {
 	}
 	var handshake protocol.Handshake
 	if err := proto.Unmarshal(packet.GetBody(), &handshake); err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrCorruptMessage, err)
 	}
+	switch compression := handshake.GetSupportedCompressions(); compression {
+	case protocol.Compression_COMPRESSIONCOMPATIBLEPROTO2, protocol.Compression_NONE,
+		protocol.Compression_ZLIB, protocol.Compression_GZIP, protocol.Compression_LZF:
+		atomic.StoreInt32(&c.compression, int32(compression))
+	default:
+		return protocol.ErrUnsupportedCompression
+	}
+
 	seed := handshake.GetSeeds()
 	newPasswd := c.opts.password
 	if newPasswd != "" {
 		newPasswd = hex.EncodeToString(Scramble411([]byte(newPasswd), seed))
 	}
 	clientAuth := &protocol.ClientAuth{
-		Username:               c.opts.username,
-		Password:               []byte(newPasswd),
-		NetReadTimeoutPresent:  &protocol.ClientAuth_NetReadTimeout{NetReadTimeout: int32(c.opts.readTimeout.Seconds())},
-		NetWriteTimeoutPresent: &protocol.ClientAuth_NetWriteTimeout{NetWriteTimeout: int32(c.opts.writeTimeout.Seconds())},
+		Username:    c.opts.username,
+		Password:    []byte(newPasswd),
+		Destination: c.clientIdentity.destination,
+		ClientId:    strconv.Itoa(c.clientIdentity.clientId),
+		Filter:      c.clientIdentity.filter,
+	}
+	if !c.positioned && !c.opts.startTimestamp.IsZero() {
+		clientAuth.StartTimestamp = toMillis(c.opts.startTimestamp)
 	}
 	rawClientAuth, _ := proto.Marshal(clientAuth)
 	packet = &protocol.Packet{
 		Type: protocol.PacketType_CLIENTAUTHENTICATION,
 		Body: rawClientAuth,
 	}
+	start := time.Now()
 	if err := c.writePacket(packet); err != nil {
 		return err
 	}
 
-	if err := c.readPacket(packet); err != nil {
+	ack, err := c.readAck(packet)
+	if err != nil {
 		return err
 	}
-
-	if packet.GetType() != protocol.PacketType_ACK {
-		return ErrUnexpectedPacket
-	}
-	var ack protocol.Ack
-	if err := proto.Unmarshal(packet.GetBody(), &ack); err != nil {
+	c.observeRTT(start)
+	if err := newServerError("auth", ack); err != nil {
+		c.log.Error("authentication failed", F("username", c.opts.username), F("error", err))
 		return err
 	}
-	fmt.Println(ack.String())
-	if ack.GetErrorCode() > 0 {
-		return errors.New("something goes wrong when doing authentication: " + ack.GetErrorMessage())
-	}
+	// The start timestamp applies to the first connection only, a reconnect
+	// resumes from the acked cursor.
+	c.positioned = true
+	c.log.Debug("authenticated", F("username", c.opts.username))
 	return nil
 }
 
 func (c *Client) Subscribe(filter string) error {
+	return c.SubscribeContext(context.Background(), filter)
+}
+
+func (c *Client) SubscribeContext(ctx context.Context, filter string) error {
+	c.lock(0)
+	defer c.unlock()
+
+	if err := c.ensureConnected(ctx); err != nil {
+		return err
+	}
+	end := c.bindContext(ctx)
+	return end(c.subscribe(filter))
+}
+
+func (c *Client) subscribe(filter string) error {
 	packet := &protocol.Packet{}
 
 	subscribe := &protocol.Sub{
@@ -148,28 +442,45 @@ func (c *Client) Subscribe(filter string) error {
 	packet.Type = protocol.PacketType_SUBSCRIPTION
 	packet.Body, _ = proto.Marshal(subscribe)
 
+	start := time.Now()
 	if err := c.writePacket(packet); err != nil {
 		return err
 	}
 
-	if err := c.readPacket(packet); err != nil {
+	ack, err := c.readAck(packet)
+	if err != nil {
 		return err
 	}
-	if packet.GetType() != protocol.PacketType_ACK {
-		return ErrUnexpectedPacket
-	}
-	var ack protocol.Ack
-	if err := proto.Unmarshal(packet.GetBody(), &ack); err != nil {
+	c.observeRTT(start)
+	if err := newServerError("subscribe", ack); err != nil {
 		return err
 	}
-	if ack.GetErrorCode() > 0 {
-		return errors.New("failed to subscribe with reason: " + ack.GetErrorMessage())
-	}
 	c.clientIdentity.filter = filter
+	c.subscribed = true
+	c.log.Info("subscribed", F("filter", filter))
 	return nil
 }
 
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
 func (c *Client) UnSubscribe(filter string) error {
+	return c.UnSubscribeContext(context.Background(), filter)
+}
+
+func (c *Client) UnSubscribeContext(ctx context.Context, filter string) error {
+	c.lock(0)
+	defer c.unlock()
+
+	if err := c.ensureConnected(ctx); err != nil {
+		return err
+	}
+	end := c.bindContext(ctx)
+	return end(c.unSubscribe(filter))
+}
+
+func (c *Client) unSubscribe(filter string) error {
 	packet := &protocol.Packet{}
 	subscribe := &protocol.Unsub{
 		Destination: c.clientIdentity.destination,
@@ -179,28 +490,40 @@ func (c *Client) UnSubscribe(filter string) error {
 	packet.Type = protocol.PacketType_UNSUBSCRIPTION
 	packet.Body, _ = proto.Marshal(subscribe)
 
+	start := time.Now()
 	if err := c.writePacket(packet); err != nil {
 		return err
 	}
 
-	if err := c.readPacket(packet); err != nil {
+	ack, err := c.readAck(packet)
+	if err != nil {
 		return err
 	}
-
-	if packet.GetType() != protocol.PacketType_ACK {
-		return ErrUnexpectedPacket
-	}
-	var ack protocol.Ack
-	if err := proto.Unmarshal(packet.GetBody(), &ack); err != nil {
+	c.observeRTT(start)
+	if err := newServerError("unsubscribe", ack); err != nil {
 		return err
 	}
-	if ack.GetErrorCode() > 0 {
-		return errors.New("failed to unSubscribe with reason: " + ack.GetErrorMessage())
-	}
+	c.log.Info("unsubscribed", F("filter", filter))
+	c.subscribed = false
 	return nil
 }
 
 func (c *Client) Ack(batchID int64) error {
+	return c.AckContext(context.Background(), batchID)
+}
+
+// AckContext acknowledges batchID. The server does not answer acks, so
+// unlike other calls it does not wait for a pending exchange such as a long
+// polling Get and can be called from worker goroutines.
+func (c *Client) AckContext(ctx context.Context, batchID int64) error {
+	if err := c.sendContext(ctx, c.ackPacket(batchID), batchID); err != nil {
+		return err
+	}
+	c.log.Debug("acked batch", F("batchId", batchID))
+	return nil
+}
+
+func (c *Client) ackPacket(batchID int64) *protocol.Packet {
 	packet := &protocol.Packet{}
 	clientAck := &protocol.ClientAck{
 		Destination: c.clientIdentity.destination,
@@ -209,14 +532,32 @@ func (c *Client) Ack(batchID int64) error {
 	}
 	packet.Type = protocol.PacketType_CLIENTACK
 	packet.Body, _ = proto.Marshal(clientAck)
+	return packet
+}
 
-	if err := c.writePacket(packet); err != nil {
+func (c *Client) Rollback(batchID int64) error {
+	return c.RollbackContext(context.Background(), batchID)
+}
+
+// RollbackContext rolls back batchID, or every batch not acked yet when
+// batchID is zero. Like AckContext it does not wait for a pending exchange.
+func (c *Client) RollbackContext(ctx context.Context, batchID int64) error {
+	if err := c.sendContext(ctx, c.rollbackPacket(batchID), batchID); err != nil {
 		return err
 	}
+	c.log.Info("rolled back batch", F("batchId", batchID))
 	return nil
 }
 
-func (c *Client) Rollback(batchID int64) error {
+func (c *Client) rollback(batchID int64) error {
+	if err := c.writePacket(c.rollbackPacket(batchID)); err != nil {
+		return err
+	}
+	c.log.Info("rolled back batch", F("batchId", batchID))
+	return nil
+}
+
+func (c *Client) rollbackPacket(batchID int64) *protocol.Packet {
 	packet := &protocol.Packet{}
 	clientRollback := &protocol.ClientRollback{
 		Destination: c.clientIdentity.destination,
@@ -225,27 +566,90 @@ func (c *Client) Rollback(batchID int64) error {
 	}
 	packet.Type = protocol.PacketType_CLIENTROLLBACK
 	packet.Body, _ = proto.Marshal(clientRollback)
-
-	if err := c.writePacket(packet); err != nil {
-		return err
-	}
-	return nil
+	return packet
 }
 
 func (c *Client) Get(batchSize int, timeout time.Duration) (*Message, error) {
-	message, err := c.GetWithOutAck(batchSize, timeout)
+	return c.GetContext(context.Background(), batchSize, timeout)
+}
+
+func (c *Client) GetContext(ctx context.Context, batchSize int, timeout time.Duration) (*Message, error) {
+	message, err := c.GetWithOutAckContext(ctx, batchSize, timeout)
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Ack(message.ID); err != nil {
+	if err := c.AckContext(ctx, message.ID); err != nil {
 		return nil, err
 	}
 	return message, nil
 }
 
 func (c *Client) GetWithOutAck(batchSize int, timeout time.Duration) (*Message, error) {
-	packet := &protocol.Packet{}
+	return c.GetWithOutAckContext(context.Background(), batchSize, timeout)
+}
+
+// GetWithOutAckContext fetches the next batch without acknowledging it. The
+// server-side wait is bounded by timeout, the whole exchange by ctx.
+func (c *Client) GetWithOutAckContext(ctx context.Context, batchSize int, timeout time.Duration) (*Message, error) {
+	c.lock(timeout)
+	defer c.unlock()
+
+	if err := c.ensureConnected(ctx); err != nil {
+		return nil, err
+	}
+	end := c.bindContext(ctx)
+	message, err := c.getWithOutAck(batchSize, timeout)
+	if err = end(err); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (c *Client) getWithOutAck(batchSize int, timeout time.Duration) (*Message, error) {
+	packet := c.getPacket(batchSize, timeout)
+	start := time.Now()
+	if err := c.writePacket(packet); err != nil {
+		return nil, err
+	}
+
+	// The server may hold the request for up to timeout before answering,
+	// only a negative timeout is answered right away.
+	wait := timeout
+	if wait < 0 {
+		wait = 0
+	}
+	if err := c.readPacketWait(packet, wait); err != nil {
+		return nil, err
+	}
+	if timeout < 0 {
+		c.observeRTT(start)
+	}
+	message, err := c.parseMessage(packet)
+	if err != nil {
+		var entryErr *EntryError
+		if errors.As(err, &entryErr) {
+			c.track(entryErr.BatchID)
+		}
+		return nil, err
+	}
+	c.track(message.ID)
+	return message, nil
+}
 
+// track records that batchID was fetched on the current connection, until it
+// is acked or rolled back. It only matters to tell stale acks after a
+// rollback on connect: without one, batches are not tracked at all.
+func (c *Client) track(batchID int64) {
+	if batchID <= 0 || !c.opts.rollbackOnConnect {
+		return
+	}
+	c.wmu.Lock()
+	c.batches[batchID] = struct{}{}
+	c.wmu.Unlock()
+}
+
+func (c *Client) getPacket(batchSize int, timeout time.Duration) *protocol.Packet {
+	packet := &protocol.Packet{}
 	get := &protocol.Get{
 		AutoAckPresent: &protocol.Get_AutoAck{AutoAck: false},
 		Destination:    c.clientIdentity.destination,
@@ -256,35 +660,174 @@ func (c *Client) GetWithOutAck(batchSize int, timeout time.Duration) (*Message,
 	}
 	packet.Type = protocol.PacketType_GET
 	packet.Body, _ = proto.Marshal(get)
+	return packet
+}
 
-	if err := c.writePacket(packet); err != nil {
+// parseMessage decodes the answer to a Get. A reply of another type than
+// MESSAGES leaves the stream out of sync and marks the connection broken. A
+// reply that does not decode was still read whole, the stream stays in sync;
+// an entry failing to decode is reported with an *EntryError carrying the
+// batch ID, for the caller to ack or roll back the batch.
+func (c *Client) parseMessage(packet *protocol.Packet) (*Message, error) {
+	message, err := decodeMessage(packet, c.opts.lazyParseEntry, c.opts.entryFilter, c.opts.maxFrameSize)
+	if err != nil {
+		if errors.Is(err, ErrUnexpectedPacket) {
+			c.markBroken()
+		}
+		c.log.Error("get failed", F("error", err))
 		return nil, err
 	}
 
-	if err := c.readPacket(packet); err != nil {
-		return nil, err
+	c.log.Debug("got batch", F("batchId", message.ID), F("entries", message.Len()),
+		F("compression", packet.GetCompression().String()))
+	return message, nil
+}
+
+// armDeadline sets the deadline of the next read or write to the earliest of
+// the bound context deadline and timeout from now. Once the bound context is
+// done the deadline is left in the past.
+func (c *Client) armDeadline(set func(time.Time) error, timeout time.Duration) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.interrupted {
+		return
+	}
+	deadline := c.ctxDeadline
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
 	}
+	_ = set(deadline)
+}
 
-	message, err := ParseMessage(packet, c.opts.lazyParseEntry)
-	if err != nil {
+// readAck reads the Ack packet answering a request.
+func (c *Client) readAck(p *protocol.Packet) (*protocol.Ack, error) {
+	if err := c.readPacket(p); err != nil {
 		return nil, err
 	}
-
-	return message, nil
+	if p.GetType() != protocol.PacketType_ACK {
+		c.markBroken()
+		return nil, ErrUnexpectedPacket
+	}
+	ack := &protocol.Ack{}
+	if err := proto.Unmarshal(p.GetBody(), ack); err != nil {
+		c.markBroken()
+		return nil, fmt.Errorf("%w: %v", ErrCorruptMessage, err)
+	}
+	return ack, nil
 }
 
 func (c *Client) readPacket(p *protocol.Packet) error {
+	return c.readPacketWait(p, 0)
+}
+
+// readPacketWait reads a packet the server may deliberately delay by wait on
+// top of the configured read timeout.
+func (c *Client) readPacketWait(p *protocol.Packet, wait time.Duration) error {
 	p.Reset()
 
-	if err := p.Read(c.netConn); err != nil {
-		return err
+	timeout := c.opts.readTimeout
+	if timeout > 0 {
+		timeout += wait
+	}
+	c.armDeadline(c.netConn.SetReadDeadline, timeout)
+	if err := p.ReadLimit(c.netConn, c.opts.maxFrameSize); err != nil {
+		c.markBroken()
+		return &OpError{Op: "read", Addr: c.addr, Err: err}
 	}
 	return nil
 }
 
 func (c *Client) writePacket(p *protocol.Packet) error {
-	if err := p.Write(c.netConn); err != nil {
+	if err := c.send(p); err != nil {
+		c.markBroken()
 		return err
 	}
 	return nil
 }
+
+// sendContext writes an ack or a rollback of batchID, which the server does
+// not answer, without waiting for the exchange in progress. A broken
+// connection is first restored holding mu, like any other call would. Once a
+// reconnect rolled back the batches fetched before it, acking one of them
+// fails and rolling it back does nothing.
+func (c *Client) sendContext(ctx context.Context, p *protocol.Packet, batchID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	switch c.getState() {
+	case stateClosed:
+		return ErrClientClosed
+	case stateBroken:
+		c.lock(0)
+		err := c.ensureConnected(ctx)
+		c.unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// A reconnect may have started meanwhile: the connection then carries a
+	// handshake the packet must not interleave with.
+	switch c.getState() {
+	case stateConnected:
+	case stateClosed:
+		return ErrClientClosed
+	default:
+		return ErrConnectionBroken
+	}
+	if _, live := c.batches[batchID]; !live && batchID > 0 && batchID >= c.staleLo && batchID <= c.staleHi {
+		if p.GetType() == protocol.PacketType_CLIENTROLLBACK {
+			return nil
+		}
+		return fmt.Errorf("batch %d was rolled back when reconnecting: %w", batchID, ErrConnectionBroken)
+	}
+
+	deadline, _ := ctx.Deadline()
+	if timeout := c.opts.writeTimeout; timeout > 0 {
+		if t := time.Now().Add(timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	c.deadlineMu.Lock()
+	if c.interrupted {
+		// A canceled exchange is tearing the connection down.
+		c.deadlineMu.Unlock()
+		return ErrConnectionBroken
+	}
+	_ = c.netConn.SetWriteDeadline(deadline)
+	c.deadlineMu.Unlock()
+	if err := p.Write(c.netConn); err != nil {
+		c.markBroken()
+		return &OpError{Op: "write", Addr: c.addr, Err: err}
+	}
+	c.forget(batchID)
+	return nil
+}
+
+// forget stops tracking batchID once acked or rolled back, or every batch
+// when batchID is zero. The caller holds wmu.
+func (c *Client) forget(batchID int64) {
+	if batchID != 0 {
+		delete(c.batches, batchID)
+		return
+	}
+	for id := range c.batches {
+		delete(c.batches, id)
+	}
+}
+
+// send writes p holding wmu only. The caller holds mu, or otherwise owns the
+// connection.
+func (c *Client) send(p *protocol.Packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.armDeadline(c.netConn.SetWriteDeadline, c.opts.writeTimeout)
+	if err := p.Write(c.netConn); err != nil {
+		return &OpError{Op: "write", Addr: c.addr, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package canaltest
+
+import (
+	"github.com/katakurin/canal/protobuf/entry"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// RowEntry builds a ROWDATA entry of eventType on schema.table carrying rows.
+func RowEntry(schema, table string, eventType entry.EventType, rows ...*entry.RowData) *entry.Entry {
+	change := &entry.RowChange{
+		EventTypePresent: &entry.RowChange_EventType{EventType: eventType},
+		RowDatas:         rows,
+	}
+	return newEntry(schema, table, eventType, entry.EntryType_ROWDATA, change)
+}
+
+// DDLEntry builds a ROWDATA entry carrying the DDL statement sql.
+func DDLEntry(schema, table string, eventType entry.EventType, sql string) *entry.Entry {
+	change := &entry.RowChange{
+		EventTypePresent: &entry.RowChange_EventType{EventType: eventType},
+		IsDdlPresent:     &entry.RowChange_IsDdl{IsDdl: true},
+		Sql:              sql,
+		DdlSchemaName:    schema,
+	}
+	return newEntry(schema, table, eventType, entry.EntryType_ROWDATA, change)
+}
+
+// BeginEntry builds a TRANSACTIONBEGIN entry for threadID.
+func BeginEntry(threadID int64) *entry.Entry {
+	return newEntry("", "", entry.EventType_QUERY, entry.EntryType_TRANSACTIONBEGIN, &entry.TransactionBegin{ThreadId: threadID})
+}
+
+// EndEntry builds a TRANSACTIONEND entry for transactionID.
+func EndEntry(transactionID string) *entry.Entry {
+	return newEntry("", "", entry.EventType_QUERY, entry.EntryType_TRANSACTIONEND, &entry.TransactionEnd{TransactionId: transactionID})
+}
+
+// Column builds a column named name holding value, or NULL when value is nil.
+func Column(name, mysqlType string, value *string) *entry.Column {
+	column := &entry.Column{
+		Name:          name,
+		MysqlType:     mysqlType,
+		IsNullPresent: &entry.Column_IsNull{IsNull: value == nil},
+	}
+	if value != nil {
+		column.Value = *value
+	}
+	return column
+}
+
+func newEntry(schema, table string, eventType entry.EventType, entryType entry.EntryType, value proto.Message) *entry.Entry {
+	storeValue, _ := proto.Marshal(value)
+	return &entry.Entry{
+		Header: &entry.Header{
+			SchemaName:       schema,
+			TableName:        table,
+			EventTypePresent: &entry.Header_EventType{EventType: eventType},
+		},
+		EntryTypePresent: &entry.Entry_EntryType{EntryType: entryType},
+		StoreValue:       storeValue,
+	}
+}
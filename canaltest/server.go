@@ -0,0 +1,397 @@
+// Package canaltest provides an in-process canal server for testing code
+// built on canal.Client without a real Java canal server.
+package canaltest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/protobuf/entry"
+	"github.com/katakurin/canal/protobuf/protocol"
+	"github.com/katakurin/canal/server"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Server is a scripted canal server, a server.Server fed with batches.
+// Batches enqueued for a destination are handed out one per Get, in order,
+// to every client of that destination; each client has its own cursor
+// driven by ClientAck and ClientRollback. Like the Java server, it answers
+// HEARTBEAT packets with an error and hangs up.
+type Server struct {
+	srv      *server.Server
+	source   *batchSource
+	listener net.Listener
+	served   chan struct{}
+
+	mu           sync.Mutex
+	username     string
+	passwordHash []byte
+	authFailure  string
+	failures     map[protocol.PacketType]*protocol.Packet
+	drops        map[protocol.PacketType]bool
+	conns        map[net.Conn]struct{}
+	accepted     int
+	acked        map[clientKey][]int64
+	rollbacks    map[clientKey]int
+	auths        []*protocol.ClientAuth
+}
+
+type clientKey struct {
+	destination string
+	clientID    string
+}
+
+var (
+	errDropped   = errors.New("canaltest: connection dropped")
+	errHeartbeat = errors.New("packet type=HEARTBEAT is NOT supported!")
+)
+
+// NewServer starts a server listening on a random loopback port.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("canaltest: failed to listen: " + err.Error())
+	}
+	return NewServerListener(l)
+}
+
+// NewServerListener starts a server accepting connections from l.
+func NewServerListener(l net.Listener) *Server {
+	s := &Server{
+		source:    newBatchSource(),
+		served:    make(chan struct{}),
+		failures:  make(map[protocol.PacketType]*protocol.Packet),
+		drops:     make(map[protocol.PacketType]bool),
+		conns:     make(map[net.Conn]struct{}),
+		acked:     make(map[clientKey][]int64),
+		rollbacks: make(map[clientKey]int),
+	}
+	s.listener = &listener{Listener: l, s: s}
+	s.srv = server.New(s.source,
+		server.WithAuthenticator(authenticator{s}),
+		server.WithInterceptor(s.intercept))
+	go func() {
+		defer close(s.served)
+		_ = s.srv.Serve(s.listener)
+	}()
+	return s
+}
+
+// Addr returns the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting connections, drops the open ones and waits for all
+// of them to finish.
+func (s *Server) Close() error {
+	err := s.srv.Close()
+	<-s.served
+	return err
+}
+
+// SetCredentials makes the server require username and password, verified
+// through Scramble411 like the Java server does.
+func (s *Server) SetCredentials(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username = username
+	s.passwordHash = canal.PasswordSHA1SHA1([]byte(password))
+}
+
+// SetAuthFailure makes every authentication fail with message. An empty
+// message restores normal authentication.
+func (s *Server) SetAuthFailure(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authFailure = message
+}
+
+// SetCompression advertises c in the handshake of the connections accepted
+// from now on and compresses their MESSAGES packets with it.
+func (s *Server) SetCompression(c protocol.Compression) {
+	s.srv.SetCompression(c)
+}
+
+// FailNext answers the next packet of type t with an error Ack carrying code
+// and message instead of handling it.
+func (s *Server) FailNext(t protocol.PacketType, code int32, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[t] = server.ErrorAck(code, message)
+}
+
+// DropNext closes the connection that sends the next packet of type t,
+// without answering it.
+func (s *Server) DropNext(t protocol.PacketType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drops[t] = true
+}
+
+// DropConnections closes every open client connection.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// Accepted returns how many connections the server has accepted so far.
+func (s *Server) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Enqueue appends one batch of entries to destination. Each Get returns at
+// most one enqueued batch, truncated to the requested fetch size, and skips
+// the batches whose entries the subscription filter rejects.
+func (s *Server) Enqueue(dest string, entries ...*entry.Entry) {
+	s.source.enqueue(dest, entries)
+}
+
+// Acked returns the batch IDs clientID acknowledged on dest, in order.
+func (s *Server) Acked(dest, clientID string) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int64(nil), s.acked[clientKey{dest, clientID}]...)
+}
+
+// Rollbacks returns how many rollbacks clientID issued on dest.
+func (s *Server) Rollbacks(dest, clientID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rollbacks[clientKey{dest, clientID}]
+}
+
+// Auths returns the ClientAuth packets received so far, in order.
+func (s *Server) Auths() []*protocol.ClientAuth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*protocol.ClientAuth(nil), s.auths...)
+}
+
+// Outstanding returns the IDs of the batches clientID fetched from dest but
+// has neither acked nor rolled back.
+func (s *Server) Outstanding(dest, clientID string) []int64 {
+	info, _ := s.srv.Client(dest, clientID)
+	return info.Outstanding
+}
+
+// Subscription returns the filter clientID subscribed to dest with.
+func (s *Server) Subscription(dest, clientID string) (filter string, ok bool) {
+	info, _ := s.srv.Client(dest, clientID)
+	return info.Filter, info.Subscribed
+}
+
+// intercept injects the scripted failures and records authentications, acks
+// and rollbacks.
+func (s *Server) intercept(p *protocol.Packet, next server.HandlerFunc) (*protocol.Packet, error) {
+	s.mu.Lock()
+	if p.GetType() == protocol.PacketType_CLIENTAUTHENTICATION {
+		auth := &protocol.ClientAuth{}
+		if proto.Unmarshal(p.GetBody(), auth) == nil {
+			s.auths = append(s.auths, auth)
+		}
+	}
+	drop := s.drops[p.GetType()]
+	delete(s.drops, p.GetType())
+	failure := s.failures[p.GetType()]
+	delete(s.failures, p.GetType())
+	authFailure := s.authFailure
+	s.mu.Unlock()
+
+	switch {
+	case drop:
+		return nil, errDropped
+	case failure != nil:
+		return failure, nil
+	case authFailure != "" && p.GetType() == protocol.PacketType_CLIENTAUTHENTICATION:
+		return server.ErrorAck(400, authFailure), nil
+	case p.GetType() == protocol.PacketType_HEARTBEAT:
+		return server.ErrorAck(400, errHeartbeat.Error()), errHeartbeat
+	}
+
+	reply, err := next(p)
+	switch p.GetType() {
+	case protocol.PacketType_CLIENTACK:
+		// A handled ack is not answered.
+		var ack protocol.ClientAck
+		if reply == nil && err == nil && proto.Unmarshal(p.GetBody(), &ack) == nil && ack.GetBatchId() > 0 {
+			key := clientKey{ack.GetDestination(), ack.GetClientId()}
+			s.mu.Lock()
+			s.acked[key] = append(s.acked[key], ack.GetBatchId())
+			s.mu.Unlock()
+		}
+	case protocol.PacketType_CLIENTROLLBACK:
+		var rollback protocol.ClientRollback
+		if proto.Unmarshal(p.GetBody(), &rollback) == nil {
+			s.mu.Lock()
+			s.rollbacks[clientKey{rollback.GetDestination(), rollback.GetClientId()}]++
+			s.mu.Unlock()
+		}
+	}
+	return reply, err
+}
+
+// authenticator checks the credentials set with SetCredentials, if any.
+type authenticator struct {
+	s *Server
+}
+
+func (a authenticator) Authenticate(username string, scrambled, seed []byte, destination string) error {
+	a.s.mu.Lock()
+	defer a.s.mu.Unlock()
+	if a.s.passwordHash == nil {
+		return nil
+	}
+	if username != a.s.username || !canal.CheckScramble411(scrambled, seed, a.s.passwordHash) {
+		return errors.New("auth failed")
+	}
+	return nil
+}
+
+// listener counts accepted connections and tracks the open ones, so that
+// they can be dropped.
+type listener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &trackedConn{Conn: conn, s: l.s}
+	l.s.mu.Lock()
+	l.s.conns[c] = struct{}{}
+	l.s.accepted++
+	l.s.mu.Unlock()
+	return c, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	s *Server
+}
+
+func (c *trackedConn) Close() error {
+	c.s.mu.Lock()
+	delete(c.s.conns, c)
+	c.s.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// batchSource is a server.EntrySource handing out enqueued batches. Cursors
+// are batch indexes.
+type batchSource struct {
+	mu           sync.Mutex
+	destinations map[string]*destination
+	committed    map[clientKey]server.Cursor
+}
+
+type destination struct {
+	batches [][]*entry.Entry
+	// notify is closed and replaced whenever batches are enqueued.
+	notify chan struct{}
+}
+
+func newBatchSource() *batchSource {
+	return &batchSource{
+		destinations: make(map[string]*destination),
+		committed:    make(map[clientKey]server.Cursor),
+	}
+}
+
+func (b *batchSource) destination(name string) *destination {
+	d, ok := b.destinations[name]
+	if !ok {
+		d = &destination{notify: make(chan struct{})}
+		b.destinations[name] = d
+	}
+	return d
+}
+
+func (b *batchSource) enqueue(dest string, entries []*entry.Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := b.destination(dest)
+	d.batches = append(d.batches, entries)
+	close(d.notify)
+	d.notify = make(chan struct{})
+}
+
+func (b *batchSource) Fetch(ctx context.Context, dest string, cursor server.Cursor, max int) ([]*entry.Entry, server.Cursor, error) {
+	index := 0
+	if cursor != "" {
+		var err error
+		if index, err = strconv.Atoi(string(cursor)); err != nil {
+			return nil, cursor, err
+		}
+	}
+
+	b.mu.Lock()
+	d := b.destination(dest)
+	for {
+		for index < len(d.batches) && len(d.batches[index]) == 0 {
+			index++
+		}
+		if index < len(d.batches) {
+			break
+		}
+		notify := d.notify
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, cursor, nil
+		case <-notify:
+		}
+		b.mu.Lock()
+	}
+	entries := d.batches[index]
+	b.mu.Unlock()
+
+	if max > 0 && len(entries) > max {
+		entries = entries[:max]
+	}
+	return entries, server.Cursor(strconv.Itoa(index + 1)), nil
+}
+
+func (b *batchSource) Commit(dest, clientID string, cursor server.Cursor) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.committed[clientKey{dest, clientID}] = cursor
+	return nil
+}
+
+func (b *batchSource) Cursor(dest, clientID string) (server.Cursor, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed[clientKey{dest, clientID}], nil
+}
+
+// Seek positions a client at the first batch whose first entry executed at or
+// after timestamp.
+func (b *batchSource) Seek(dest string, timestamp int64) (server.Cursor, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := b.destination(dest)
+	for i, batch := range d.batches {
+		if len(batch) > 0 && batch[0].GetHeader().GetExecuteTime() >= timestamp {
+			return server.Cursor(strconv.Itoa(i)), nil
+		}
+	}
+	return server.Cursor(strconv.Itoa(len(d.batches))), nil
+}
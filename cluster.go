@@ -1 +1,308 @@
 package canal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoRunningServer = errors.New("no running canal server for destination")
+)
+
+// Coordinator resolves the canal server that is currently running a destination.
+type Coordinator interface {
+	// RunningServer returns the address of the server running destination and
+	// a channel that is closed as soon as that information changes.
+	RunningServer(destination string) (addr string, changed <-chan struct{}, err error)
+	Close() error
+}
+
+// ClusterClient is a Client that follows the running canal server of a
+// destination and fails over to a new one when it moves.
+type ClusterClient struct {
+	mu          sync.Mutex
+	coordinator Coordinator
+	destination string
+	opts        []ClientOption
+	clusterOpts clientOptions
+
+	client     *Client
+	addr       string
+	changed    <-chan struct{}
+	filter     string
+	subscribed bool
+	closed     bool
+}
+
+func NewClusterClient(coordinator Coordinator, destination string, opts ...ClientOption) (*ClusterClient, error) {
+	return NewClusterClientContext(context.Background(), coordinator, destination, opts...)
+}
+
+func NewClusterClientContext(ctx context.Context, coordinator Coordinator, destination string, opts ...ClientOption) (*ClusterClient, error) {
+	cc := &ClusterClient{
+		coordinator: coordinator,
+		destination: destination,
+		opts:        opts,
+		clusterOpts: defaultClientOptions(),
+	}
+	for _, opt := range opts {
+		opt.apply(&cc.clusterOpts)
+	}
+
+	if err := cc.reconnect(ctx); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Addr returns the address of the canal server currently in use.
+func (c *ClusterClient) Addr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+// Disconnect closes the connection to the running server. Later calls fail
+// with ErrClientClosed instead of connecting again.
+func (c *ClusterClient) Disconnect() error {
+	c.mu.Lock()
+	client := c.client
+	c.client = nil
+	c.closed = true
+	c.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Disconnect()
+}
+
+func (c *ClusterClient) Subscribe(filter string) error {
+	return c.SubscribeContext(context.Background(), filter)
+}
+
+func (c *ClusterClient) SubscribeContext(ctx context.Context, filter string) error {
+	return c.do(ctx, func(client *Client) error {
+		if err := client.SubscribeContext(ctx, filter); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.filter = filter
+		c.subscribed = true
+		c.mu.Unlock()
+		return nil
+	})
+}
+
+func (c *ClusterClient) UnSubscribe(filter string) error {
+	return c.UnSubscribeContext(context.Background(), filter)
+}
+
+func (c *ClusterClient) UnSubscribeContext(ctx context.Context, filter string) error {
+	return c.do(ctx, func(client *Client) error {
+		if err := client.UnSubscribeContext(ctx, filter); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.subscribed = false
+		c.mu.Unlock()
+		return nil
+	})
+}
+
+func (c *ClusterClient) Ack(batchID int64) error {
+	return c.AckContext(context.Background(), batchID)
+}
+
+func (c *ClusterClient) AckContext(ctx context.Context, batchID int64) error {
+	return c.do(ctx, func(client *Client) error {
+		return client.AckContext(ctx, batchID)
+	})
+}
+
+func (c *ClusterClient) Rollback(batchID int64) error {
+	return c.RollbackContext(context.Background(), batchID)
+}
+
+func (c *ClusterClient) RollbackContext(ctx context.Context, batchID int64) error {
+	return c.do(ctx, func(client *Client) error {
+		return client.RollbackContext(ctx, batchID)
+	})
+}
+
+func (c *ClusterClient) Get(batchSize int, timeout time.Duration) (*Message, error) {
+	return c.GetContext(context.Background(), batchSize, timeout)
+}
+
+func (c *ClusterClient) GetContext(ctx context.Context, batchSize int, timeout time.Duration) (*Message, error) {
+	var message *Message
+	err := c.do(ctx, func(client *Client) (err error) {
+		message, err = client.GetContext(ctx, batchSize, timeout)
+		return
+	})
+	return message, err
+}
+
+func (c *ClusterClient) GetWithOutAck(batchSize int, timeout time.Duration) (*Message, error) {
+	return c.GetWithOutAckContext(context.Background(), batchSize, timeout)
+}
+
+func (c *ClusterClient) GetWithOutAckContext(ctx context.Context, batchSize int, timeout time.Duration) (*Message, error) {
+	var message *Message
+	err := c.do(ctx, func(client *Client) (err error) {
+		message, err = client.GetWithOutAckContext(ctx, batchSize, timeout)
+		return
+	})
+	return message, err
+}
+
+// do runs f against the current server, switching to the new running server
+// first if it has moved, and retrying on another connection when f fails
+// with a retryable error. f runs without holding mu, so that a long polling
+// Get does not hold up acks.
+func (c *ClusterClient) do(ctx context.Context, f func(*Client) error) error {
+	var err error
+	for i := 0; i <= c.clusterOpts.clusterRetryTimes; i++ {
+		if i > 0 {
+			timer := time.NewTimer(c.clusterOpts.clusterRetryInterval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		var client *Client
+		if client, err = c.current(ctx); err != nil {
+			if !IsRetryable(err) {
+				return err
+			}
+			continue
+		}
+		if err = f(client); err == nil {
+			return nil
+		}
+		if !IsRetryable(err) {
+			return err
+		}
+		c.mu.Lock()
+		if c.client == client {
+			c.client = nil
+		}
+		c.mu.Unlock()
+		_ = client.Disconnect()
+	}
+	return err
+}
+
+// current returns the client of the running server, connecting to it first
+// if needed.
+func (c *ClusterClient) current(ctx context.Context) (*Client, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	if c.client != nil && !c.moved() {
+		defer c.mu.Unlock()
+		return c.client, nil
+	}
+	stale := c.client
+	c.client = nil
+	err := c.reconnect(ctx)
+	client := c.client
+	c.mu.Unlock()
+
+	// The stale client may still be in use by a concurrent call, which
+	// Disconnect waits for.
+	if stale != nil {
+		_ = stale.Disconnect()
+	}
+	return client, err
+}
+
+func (c *ClusterClient) moved() bool {
+	select {
+	case <-c.changed:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconnect connects to the running server, holding mu.
+func (c *ClusterClient) reconnect(ctx context.Context) error {
+	addr, changed, err := c.coordinator.RunningServer(c.destination)
+	if err != nil {
+		return err
+	}
+	client, err := NewClientContext(ctx, addr, c.destination, c.opts...)
+	if err != nil {
+		return err
+	}
+	if c.subscribed {
+		if err := client.SubscribeContext(ctx, c.filter); err != nil {
+			_ = client.Disconnect()
+			return err
+		}
+	}
+
+	if c.addr != "" && c.addr != addr {
+		c.clusterOpts.logger.Warn("running canal server moved", F("destination", c.destination),
+			F("from", c.addr), F("to", addr))
+	}
+	c.client = client
+	c.addr = addr
+	c.changed = changed
+	return nil
+}
+
+// MemoryCoordinator is an in-process Coordinator whose running servers are
+// set by hand. It is mostly useful in tests.
+type MemoryCoordinator struct {
+	mu      sync.Mutex
+	running map[string]*memoryRunning
+}
+
+type memoryRunning struct {
+	addr    string
+	changed chan struct{}
+}
+
+func NewMemoryCoordinator() *MemoryCoordinator {
+	return &MemoryCoordinator{
+		running: make(map[string]*memoryRunning),
+	}
+}
+
+// SetRunning records addr as the running server of destination. An empty addr
+// marks the destination as not running.
+func (m *MemoryCoordinator) SetRunning(destination, addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, ok := m.running[destination]; ok {
+		close(old.changed)
+	}
+	m.running[destination] = &memoryRunning{
+		addr:    addr,
+		changed: make(chan struct{}),
+	}
+}
+
+func (m *MemoryCoordinator) RunningServer(destination string) (string, <-chan struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	running, ok := m.running[destination]
+	if !ok || running.addr == "" {
+		return "", nil, ErrNoRunningServer
+	}
+	return running.addr, running.changed, nil
+}
+
+func (m *MemoryCoordinator) Close() error {
+	return nil
+}
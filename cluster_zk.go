@@ -0,0 +1,173 @@
+package canal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// ZKCoordinator discovers running canal servers the same way the Java
+// ClusterCanalConnector does, by reading the running node each destination
+// registers in ZooKeeper. Each destination asked for is watched by a single
+// loop, whose result every caller shares.
+type ZKCoordinator struct {
+	conn *zk.Conn
+
+	mu      sync.Mutex
+	running map[string]*zkRunning
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// zkRunning is the last known running server of a destination. changed is
+// closed and replaced whenever addr changes.
+type zkRunning struct {
+	ready   chan struct{}
+	addr    string
+	err     error
+	changed chan struct{}
+}
+
+type zkRunningData struct {
+	Cid     int64  `json:"cid"`
+	Address string `json:"address"`
+	Active  bool   `json:"active"`
+}
+
+// zkRetryInterval is how long a watch loop waits after a ZooKeeper error.
+const zkRetryInterval = time.Second
+
+func NewZKCoordinator(servers []string, sessionTimeout time.Duration) (*ZKCoordinator, error) {
+	conn, _, err := zk.Connect(servers, sessionTimeout, zk.WithLogInfo(false))
+	if err != nil {
+		return nil, err
+	}
+	return &ZKCoordinator{
+		conn:    conn,
+		running: make(map[string]*zkRunning),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func zkRunningPath(destination string) string {
+	return fmt.Sprintf("/otter/canal/destinations/%s/running", destination)
+}
+
+func (z *ZKCoordinator) RunningServer(destination string) (string, <-chan struct{}, error) {
+	z.mu.Lock()
+	running, ok := z.running[destination]
+	if !ok {
+		select {
+		case <-z.done:
+			z.mu.Unlock()
+			return "", nil, ErrClientClosed
+		default:
+		}
+		running = &zkRunning{ready: make(chan struct{}), changed: make(chan struct{})}
+		z.running[destination] = running
+		z.wg.Add(1)
+		go z.watch(destination, running)
+	}
+	z.mu.Unlock()
+
+	<-running.ready
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if running.err != nil {
+		return "", nil, running.err
+	}
+	return running.addr, running.changed, nil
+}
+
+// watch keeps running up to date with the running node of destination until
+// the coordinator is closed.
+func (z *ZKCoordinator) watch(destination string, running *zkRunning) {
+	defer z.wg.Done()
+	first := true
+	for {
+		addr, events, err := z.read(destination)
+
+		// While ZooKeeper is unreachable the last known server is kept.
+		if first || events != nil {
+			z.mu.Lock()
+			if !first && addr != running.addr {
+				close(running.changed)
+				running.changed = make(chan struct{})
+			}
+			running.addr, running.err = addr, err
+			z.mu.Unlock()
+		}
+		if first {
+			close(running.ready)
+			first = false
+		}
+
+		if events == nil {
+			// ZooKeeper failed, there is nothing to watch: poll again later.
+			timer := time.NewTimer(zkRetryInterval)
+			select {
+			case <-z.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			continue
+		}
+		select {
+		case <-z.done:
+			return
+		case <-events:
+		}
+	}
+}
+
+// read returns the running server of destination and a watch on its running
+// node, which may not exist yet.
+func (z *ZKCoordinator) read(destination string) (string, <-chan zk.Event, error) {
+	path := zkRunningPath(destination)
+	for {
+		data, _, events, err := z.conn.GetW(path)
+		if err == zk.ErrNoNode {
+			var exists bool
+			if exists, _, events, err = z.conn.ExistsW(path); err != nil {
+				return "", nil, err
+			}
+			if exists {
+				// Created meanwhile, read it.
+				continue
+			}
+			return "", events, ErrNoRunningServer
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return parseZKRunning(destination, data, events)
+	}
+}
+
+func parseZKRunning(destination string, data []byte, events <-chan zk.Event) (string, <-chan zk.Event, error) {
+	var running zkRunningData
+	if err := json.Unmarshal(data, &running); err != nil {
+		return "", events, fmt.Errorf("bad running data for destination %s: %v", destination, err)
+	}
+	if !running.Active || running.Address == "" {
+		return "", events, ErrNoRunningServer
+	}
+	return running.Address, events, nil
+}
+
+func (z *ZKCoordinator) Close() error {
+	z.mu.Lock()
+	select {
+	case <-z.done:
+	default:
+		close(z.done)
+	}
+	z.mu.Unlock()
+	z.conn.Close()
+	z.wg.Wait()
+	return nil
+}
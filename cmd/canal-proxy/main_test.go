@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/canaltest"
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+func TestRun(t *testing.T) {
+	upstream := canaltest.NewServer()
+	defer upstream.Close()
+	upstream.Enqueue("example", canaltest.RowEntry("db", "orders", entry.EventType_INSERT))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := l.Addr().String()
+	l.Close()
+	data := t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, []string{
+			"-upstream", "canal://" + upstream.Addr() + "/example?timeout=50ms",
+			"-listen", listen,
+			"-consumers", "1001",
+			"-data", data,
+			"-username", "canal",
+			"-password", "secret",
+		})
+	}()
+
+	var client *canal.Client
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if client, err = canal.NewClient(listen, "example", canal.WithCredentials("canal", "secret")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer client.Disconnect()
+	if err := client.Subscribe(""); err != nil {
+		t.Fatal(err)
+	}
+	message, err := client.Get(10, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Len() != 1 || message.Entries[0].GetHeader().GetTableName() != "orders" {
+		t.Fatalf("got %d entries, want the orders one", message.Len())
+	}
+	// The ack is fire-and-forget, a second exchange makes sure it was handled.
+	if _, err := client.GetWithOutAck(10, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run returned %v after being canceled", err)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(data, "*.log")); len(segments) == 0 {
+		t.Fatal("no segment written")
+	}
+	if _, err := os.Stat(filepath.Join(data, "state.json")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunBadUpstream(t *testing.T) {
+	if err := run(context.Background(), []string{"-upstream", "mysql://127.0.0.1/example"}); err == nil {
+		t.Fatal("run accepted a bad upstream DSN")
+	}
+}
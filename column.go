@@ -0,0 +1,368 @@
+package canal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+var (
+	ErrInvalidColumnValue = errors.New("invalid column value")
+)
+
+// ColumnType is a parsed MySQL column type such as "decimal(10,2)",
+// "bigint(20) unsigned" or "enum('a','b')".
+type ColumnType struct {
+	// Name is the lower-case base type, e.g. "decimal".
+	Name string
+	// Length is the display width, length or precision, zero when absent.
+	Length int
+	// Scale is the number of fractional digits of decimal types.
+	Scale    int
+	Unsigned bool
+	// Elements lists the members of enum and set types.
+	Elements []string
+}
+
+// ParseColumnType parses the MysqlType of an entry.Column.
+func ParseColumnType(mysqlType string) ColumnType {
+	s := strings.ToLower(strings.TrimSpace(mysqlType))
+	var t ColumnType
+	end := strings.IndexAny(s, "( ")
+	if end < 0 {
+		t.Name = s
+		return t
+	}
+	t.Name = s[:end]
+	rest := s[end:]
+
+	if strings.HasPrefix(rest, "(") {
+		// Enum and set members are quoted and may contain parentheses.
+		if t.Name == "enum" || t.Name == "set" {
+			// Keep the case of the members.
+			orig := strings.TrimSpace(mysqlType)
+			t.Elements, rest = parseElements(orig[end+1:])
+			rest = strings.ToLower(rest)
+		} else if close := strings.IndexByte(rest, ')'); close > 0 {
+			args := strings.Split(rest[1:close], ",")
+			t.Length, _ = strconv.Atoi(strings.TrimSpace(args[0]))
+			if len(args) > 1 {
+				t.Scale, _ = strconv.Atoi(strings.TrimSpace(args[1]))
+			}
+			rest = rest[close+1:]
+		}
+	}
+	for _, attr := range strings.Fields(rest) {
+		if attr == "unsigned" {
+			t.Unsigned = true
+		}
+	}
+	return t
+}
+
+// parseElements parses the quoted, comma separated members of an enum or
+// set, up to the closing parenthesis, and returns them with what follows.
+func parseElements(s string) ([]string, string) {
+	elements := []string{}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case ')':
+			return elements, s[i+1:]
+		case '\'':
+			var b strings.Builder
+			for i++; i < len(s); i++ {
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			elements = append(elements, b.String())
+		}
+	}
+	return elements, ""
+}
+
+// ColumnConverter turns column values, which canal renders as text, into Go
+// values. The zero value interprets dates and times in UTC.
+type ColumnConverter struct {
+	// Location is the time zone of DATETIME and TIMESTAMP values, that is the
+	// time zone of the canal server. Nil means UTC.
+	Location *time.Location
+}
+
+// ColumnValue converts col with the zero ColumnConverter.
+func ColumnValue(col *entry.Column) (interface{}, error) {
+	return ColumnConverter{}.Value(col)
+}
+
+// Value returns the value of col as:
+//
+//	nil               NULL
+//	int64             signed integer types
+//	uint64            unsigned integer types, BIT(n) with n > 1
+//	bool              BIT(1)
+//	float32, float64  FLOAT, DOUBLE
+//	Decimal           DECIMAL
+//	time.Time         DATE, DATETIME, TIMESTAMP; zero dates give the zero Time
+//	time.Duration     TIME
+//	int64             YEAR
+//	[]byte            BINARY, VARBINARY and BLOB types
+//	json.RawMessage   JSON
+//	[]string          SET
+//	string            anything else, including ENUM
+//
+// Errors wrap ErrInvalidColumnValue.
+func (c ColumnConverter) Value(col *entry.Column) (interface{}, error) {
+	v, err := c.value(col)
+	if err != nil {
+		return nil, fmt.Errorf("column %s: %w", col.GetName(), err)
+	}
+	return v, nil
+}
+
+func (c ColumnConverter) value(col *entry.Column) (interface{}, error) {
+	if col.GetIsNull() {
+		return nil, nil
+	}
+	t := ParseColumnType(col.GetMysqlType())
+	v, err := c.convert(t, col.GetValue())
+	if err != nil {
+		return nil, fmt.Errorf("%w of type %s: %v", ErrInvalidColumnValue, col.GetMysqlType(), err)
+	}
+	return v, nil
+}
+
+func (c ColumnConverter) convert(t ColumnType, value string) (interface{}, error) {
+	switch t.Name {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		if t.Unsigned {
+			return strconv.ParseUint(value, 10, 64)
+		}
+		return strconv.ParseInt(value, 10, 64)
+
+	case "bit":
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if t.Length <= 1 {
+			return v != 0, nil
+		}
+		return v, nil
+
+	case "float":
+		v, err := strconv.ParseFloat(value, 32)
+		return float32(v), err
+
+	case "double", "real":
+		return strconv.ParseFloat(value, 64)
+
+	case "decimal", "numeric", "dec", "fixed":
+		d, err := ParseDecimal(value)
+		if err != nil {
+			return nil, err
+		}
+		if d.scale < t.Scale {
+			d = d.rescale(t.Scale)
+		}
+		return d, nil
+
+	case "year":
+		return strconv.ParseInt(value, 10, 64)
+
+	case "date":
+		return c.parseTime("2006-01-02", value, 0)
+
+	case "datetime", "timestamp":
+		return c.parseTime("2006-01-02 15:04:05", value, t.Length)
+
+	case "time":
+		return parseDuration(value)
+
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		b, err := latin1Bytes(value)
+		if err != nil {
+			return nil, err
+		}
+		// BINARY(n) values are right-padded with zero bytes.
+		if t.Name == "binary" && len(b) < t.Length {
+			b = append(b, make([]byte, t.Length-len(b))...)
+		}
+		return b, nil
+
+	case "json":
+		return json.RawMessage(value), nil
+
+	case "set":
+		if value == "" {
+			return []string{}, nil
+		}
+		return strings.Split(value, ","), nil
+
+	default:
+		return value, nil
+	}
+}
+
+// parseTime parses a date or time rendered by canal, keeping fsp fractional
+// digits of the seconds.
+func (c ColumnConverter) parseTime(layout, value string, fsp int) (time.Time, error) {
+	if strings.HasPrefix(value, "0000-00-00") {
+		return time.Time{}, nil
+	}
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	// The fraction is accepted even though the layout does not mention it.
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if fsp < 9 {
+		unit := time.Second
+		for i := 0; i < fsp; i++ {
+			unit /= 10
+		}
+		t = t.Truncate(unit)
+	}
+	return t, nil
+}
+
+// parseDuration parses a TIME value, [-]HHH:MM:SS[.ffffff].
+func parseDuration(value string) (time.Duration, error) {
+	s := value
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("malformed time %q", value)
+	}
+	hours, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	seconds, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return 0, err
+	}
+	d := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)+0.5)
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
+
+// latin1Bytes recovers binary values, which canal renders as ISO-8859-1
+// text: every byte became the rune of the same value.
+func latin1Bytes(value string) ([]byte, error) {
+	b := make([]byte, 0, len(value))
+	for _, r := range value {
+		if r > 0xff {
+			return nil, fmt.Errorf("rune %U is not latin1", r)
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
+
+// Decimal is an exact decimal number, unscaled * 10^-scale.
+type Decimal struct {
+	unscaled *big.Int
+	scale    int
+}
+
+// ParseDecimal parses a decimal number such as "-123.450".
+func ParseDecimal(s string) (Decimal, error) {
+	digits := s
+	scale := 0
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		digits = s[:dot] + s[dot+1:]
+		scale = len(s) - dot - 1
+	}
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Decimal{}, fmt.Errorf("malformed decimal %q", s)
+	}
+	return Decimal{unscaled: unscaled, scale: scale}, nil
+}
+
+func (d Decimal) rescale(scale int) Decimal {
+	factor := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale-d.scale)), nil)
+	return Decimal{unscaled: factor.Mul(factor, d.Unscaled()), scale: scale}
+}
+
+// Unscaled returns a copy of the unscaled value.
+func (d Decimal) Unscaled() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(d.unscaled)
+}
+
+// Scale returns the number of fractional digits.
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+// Rat returns d as a fraction.
+func (d Decimal) Rat() *big.Rat {
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(d.scale)), nil)
+	return new(big.Rat).SetFrac(d.Unscaled(), denom)
+}
+
+// Float64 returns the float64 nearest to d.
+func (d Decimal) Float64() float64 {
+	f, _ := d.Rat().Float64()
+	return f
+}
+
+func (d Decimal) String() string {
+	s := d.Unscaled().String()
+	if d.scale == 0 {
+		return s
+	}
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	if len(s) <= d.scale {
+		s = strings.Repeat("0", d.scale-len(s)+1) + s
+	}
+	s = s[:len(s)-d.scale] + "." + s[len(s)-d.scale:]
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+func (d Decimal) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Decimal) UnmarshalText(text []byte) error {
+	v, err := ParseDecimal(string(text))
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
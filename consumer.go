@@ -0,0 +1,250 @@
+package canal
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Connector is what a Consumer needs from a connection. Client and
+// ClusterClient both implement it.
+type Connector interface {
+	GetWithOutAckContext(ctx context.Context, batchSize int, timeout time.Duration) (*Message, error)
+	AckContext(ctx context.Context, batchID int64) error
+	RollbackContext(ctx context.Context, batchID int64) error
+}
+
+// Handler processes the batches a Consumer fetches. Returning nil acks the
+// batch, returning an error rolls it back so that it is fetched again.
+type Handler interface {
+	Handle(ctx context.Context, message *Message) error
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(ctx context.Context, message *Message) error
+
+func (f HandlerFunc) Handle(ctx context.Context, message *Message) error {
+	return f(ctx, message)
+}
+
+type consumerOptions struct {
+	batchSize   int
+	pollTimeout time.Duration
+	idle        Backoff
+	retry       Backoff
+	logger      Logger
+}
+
+func defaultConsumerOptions() consumerOptions {
+	return consumerOptions{
+		batchSize:   100,
+		pollTimeout: time.Second,
+		idle: Backoff{
+			Initial:    100 * time.Millisecond,
+			Max:        time.Second,
+			Multiplier: 2,
+		},
+		retry: Backoff{
+			Initial:    time.Second,
+			Max:        30 * time.Second,
+			Multiplier: 2,
+		},
+		logger: NopLogger(),
+	}
+}
+
+// ConsumerOption configures a Consumer.
+type ConsumerOption interface {
+	apply(*consumerOptions)
+}
+
+type funcConsumerOption struct {
+	f func(*consumerOptions)
+}
+
+func (fco *funcConsumerOption) apply(co *consumerOptions) {
+	fco.f(co)
+}
+
+func newFuncConsumerOption(f func(*consumerOptions)) *funcConsumerOption {
+	return &funcConsumerOption{
+		f: f,
+	}
+}
+
+// WithBatchSize sets how many entries a Consumer fetches at most per batch.
+func WithBatchSize(n int) ConsumerOption {
+	return newFuncConsumerOption(func(o *consumerOptions) {
+		o.batchSize = n
+	})
+}
+
+// WithPollTimeout sets how long the server holds a Get waiting for entries.
+func WithPollTimeout(timeout time.Duration) ConsumerOption {
+	return newFuncConsumerOption(func(o *consumerOptions) {
+		o.pollTimeout = timeout
+	})
+}
+
+// WithIdleBackoff sets how long a Consumer sleeps after consecutive empty
+// batches. MaxRetries is ignored.
+func WithIdleBackoff(b Backoff) ConsumerOption {
+	return newFuncConsumerOption(func(o *consumerOptions) {
+		o.idle = b
+	})
+}
+
+// WithRetryPolicy sets how long a Consumer waits after a handler or
+// connection failure. Run gives up after MaxRetries consecutive failures, or
+// never when it is zero, the default.
+func WithRetryPolicy(b Backoff) ConsumerOption {
+	return newFuncConsumerOption(func(o *consumerOptions) {
+		o.retry = b
+	})
+}
+
+func WithConsumerLogger(logger Logger) ConsumerOption {
+	return newFuncConsumerOption(func(o *consumerOptions) {
+		o.logger = logger
+	})
+}
+
+// Consumer fetches batches from a Connector in a loop and hands them to a
+// Handler, acking or rolling back each batch depending on the outcome.
+type Consumer struct {
+	conn Connector
+	opts consumerOptions
+}
+
+// NewConsumer creates a Consumer of conn, which must already be subscribed.
+func NewConsumer(conn Connector, opts ...ConsumerOption) *Consumer {
+	c := &Consumer{
+		conn: conn,
+		opts: defaultConsumerOptions(),
+	}
+	for _, opt := range opts {
+		opt.apply(&c.opts)
+	}
+	return c
+}
+
+// Run consumes batches until ctx is done, then rolls back the batch being
+// fetched or handled, if any, and returns nil. It returns an error when the
+// connection fails with a non retryable error, or when the retry policy is
+// exhausted.
+func (c *Consumer) Run(ctx context.Context, handler Handler) error {
+	log := c.opts.logger
+	idle, failures := 0, 0
+
+	for {
+		message, err := c.conn.GetWithOutAckContext(ctx, c.opts.batchSize, c.opts.pollTimeout)
+		if ctx.Err() != nil {
+			// The batch arrived as ctx was canceled, give it back.
+			if err == nil && message.ID > 0 {
+				c.rollback(ctx, message.ID)
+			}
+			return nil
+		}
+		if err != nil {
+			if !IsRetryable(err) {
+				return err
+			}
+			failures++
+			if err := c.backoff(ctx, failures, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if message.ID == -1 || message.Len() == 0 {
+			if message.ID > 0 {
+				if err := c.conn.AckContext(ctx, message.ID); err != nil && ctx.Err() == nil {
+					return err
+				}
+			}
+			if !sleep(ctx, c.opts.idle.delay(idle)) {
+				return nil
+			}
+			idle++
+			continue
+		}
+		idle = 0
+
+		if err := handler.Handle(ctx, message); err != nil {
+			c.rollback(ctx, message.ID)
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Warn("canal handler failed, batch rolled back", F("batchId", message.ID), F("error", err))
+			failures++
+			if err := c.backoff(ctx, failures, fmt.Errorf("batch %d: %w", message.ID, err)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// The batch was handled, ack it even when ctx was canceled meanwhile.
+		if err := c.ack(ctx, message.ID); err != nil {
+			if !IsRetryable(err) {
+				return err
+			}
+			// The connection is gone and the batch with it, it comes back
+			// after reconnecting.
+			log.Warn("canal ack failed", F("batchId", message.ID), F("error", err))
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		failures = 0
+	}
+}
+
+func (c *Consumer) ack(ctx context.Context, batchID int64) error {
+	ctx, cancel := detach(ctx)
+	defer cancel()
+	return c.conn.AckContext(ctx, batchID)
+}
+
+// rollback rolls back batchID, even when ctx is already done.
+func (c *Consumer) rollback(ctx context.Context, batchID int64) {
+	ctx, cancel := detach(ctx)
+	defer cancel()
+	if err := c.conn.RollbackContext(ctx, batchID); err != nil {
+		c.opts.logger.Warn("canal rollback failed", F("batchId", batchID), F("error", err))
+	}
+}
+
+// detach returns ctx, or a short-lived context when ctx is already done, so
+// that the outcome of a handled batch still reaches the server.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+// backoff waits before the next attempt after the failures-th consecutive
+// failure, or returns err when the retry policy is exhausted. It returns nil
+// right away when ctx is done, Run then notices.
+func (c *Consumer) backoff(ctx context.Context, failures int, err error) error {
+	if max := c.opts.retry.MaxRetries; max > 0 && failures > max {
+		return fmt.Errorf("canal consumer gave up after %d failures: %w", failures, err)
+	}
+	sleep(ctx, c.opts.retry.delay(failures-1))
+	return nil
+}
+
+// sleep waits for d and reports whether ctx is still alive.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
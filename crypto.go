@@ -2,6 +2,7 @@ package canal
 
 import (
 	"crypto/sha1"
+	"crypto/subtle"
 )
 
 func Scramble411(data []byte, seed []byte) []byte {
@@ -22,3 +23,30 @@ func Scramble411(data []byte, seed []byte) []byte {
 	}
 	return pass3
 }
+
+// CheckScramble411 verifies a Scramble411 token against the double SHA-1 of
+// the password, which is what a server stores instead of the password.
+func CheckScramble411(scrambled, seed, passwordSHA1SHA1 []byte) bool {
+	if len(scrambled) != sha1.Size {
+		return false
+	}
+	crypt := sha1.New()
+	crypt.Write(seed)
+	crypt.Write(passwordSHA1SHA1)
+	pass1 := crypt.Sum(nil)
+	for i := range pass1 {
+		pass1[i] ^= scrambled[i]
+	}
+
+	crypt.Reset()
+	crypt.Write(pass1)
+	return subtle.ConstantTimeCompare(crypt.Sum(nil), passwordSHA1SHA1) == 1
+}
+
+// PasswordSHA1SHA1 returns SHA1(SHA1(password)), the form CheckScramble411
+// expects.
+func PasswordSHA1SHA1(password []byte) []byte {
+	pass1 := sha1.Sum(password)
+	pass2 := sha1.Sum(pass1[:])
+	return pass2[:]
+}
@@ -0,0 +1,659 @@
+package canal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+var (
+	ErrMalformedDDL = errors.New("malformed DDL statement")
+)
+
+// DDLKind classifies a DDL statement.
+type DDLKind int
+
+const (
+	// DDLUnknown is any statement ParseDDL does not analyze, such as views,
+	// triggers or database statements.
+	DDLUnknown DDLKind = iota
+	DDLCreateTable
+	DDLAlterTable
+	DDLDropTable
+	DDLRenameTable
+	DDLTruncateTable
+	DDLCreateIndex
+	DDLDropIndex
+)
+
+var ddlKindNames = [...]string{
+	DDLUnknown:       "UNKNOWN",
+	DDLCreateTable:   "CREATE TABLE",
+	DDLAlterTable:    "ALTER TABLE",
+	DDLDropTable:     "DROP TABLE",
+	DDLRenameTable:   "RENAME TABLE",
+	DDLTruncateTable: "TRUNCATE TABLE",
+	DDLCreateIndex:   "CREATE INDEX",
+	DDLDropIndex:     "DROP INDEX",
+}
+
+func (k DDLKind) String() string {
+	if k < 0 || int(k) >= len(ddlKindNames) {
+		return fmt.Sprintf("DDLKind(%d)", int(k))
+	}
+	return ddlKindNames[k]
+}
+
+// TableName is a schema qualified table name.
+type TableName struct {
+	Schema string
+	Table  string
+}
+
+func (t TableName) String() string {
+	if t.Schema == "" {
+		return t.Table
+	}
+	return t.Schema + "." + t.Table
+}
+
+// TableRename is one table renamed by RENAME TABLE or ALTER TABLE.
+type TableRename struct {
+	From TableName
+	To   TableName
+}
+
+// ColumnChangeKind classifies what ALTER TABLE does to a column.
+type ColumnChangeKind int
+
+const (
+	ColumnAdded ColumnChangeKind = iota
+	ColumnDropped
+	// ColumnRenamed is a RENAME COLUMN, or a CHANGE COLUMN giving the column
+	// a new name. The latter may change its definition too.
+	ColumnRenamed
+	// ColumnModified is a MODIFY COLUMN, a CHANGE COLUMN keeping the name or
+	// an ALTER COLUMN.
+	ColumnModified
+)
+
+var columnChangeKindNames = [...]string{
+	ColumnAdded:    "ADDED",
+	ColumnDropped:  "DROPPED",
+	ColumnRenamed:  "RENAMED",
+	ColumnModified: "MODIFIED",
+}
+
+func (k ColumnChangeKind) String() string {
+	if k < 0 || int(k) >= len(columnChangeKindNames) {
+		return fmt.Sprintf("ColumnChangeKind(%d)", int(k))
+	}
+	return columnChangeKindNames[k]
+}
+
+// ColumnChange is a change ALTER TABLE makes to one column.
+type ColumnChange struct {
+	Kind ColumnChangeKind
+	// Name is the name of the column after the change.
+	Name string
+	// OldName is the previous name of renamed columns.
+	OldName string
+	// Definition is the SQL text of the new column definition, such as
+	// "INT NOT NULL DEFAULT 0 AFTER id", empty when dropped or renamed by
+	// RENAME COLUMN.
+	Definition string
+}
+
+// DDLStatement is the analysis of a DDL statement.
+type DDLStatement struct {
+	Kind DDLKind
+	// Tables are the tables the statement affects, in the order it names
+	// them, renamed tables under both names.
+	Tables []TableName
+	// Renames are the tables renamed by RENAME TABLE, or by ALTER TABLE
+	// RENAME TO.
+	Renames []TableRename
+	// Index is the index created or dropped by CREATE INDEX and DROP INDEX.
+	Index string
+	// Columns are the column changes of ALTER TABLE, in order.
+	Columns []ColumnChange
+}
+
+// AnalyzeDDL analyzes the statement of a DDL row change, taking the tables
+// it does not qualify to be in the schema it ran in.
+func AnalyzeDDL(change *entry.RowChange) (*DDLStatement, error) {
+	return ParseDDL(change.GetSql(), change.GetDdlSchemaName())
+}
+
+// ParseDDL analyzes the first statement of sql, taking unqualified tables to
+// be in defaultSchema. Statements other than those of the DDLKind constants
+// give DDLUnknown. Errors wrap ErrMalformedDDL.
+func ParseDDL(sql, defaultSchema string) (*DDLStatement, error) {
+	toks, err := tokenizeSQL(sql)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedDDL, err)
+	}
+	// Only look at the first statement.
+	for i, t := range toks {
+		if t.isPunct(';') {
+			toks = toks[:i]
+			break
+		}
+	}
+	p := &ddlParser{sql: sql, toks: toks, defaultSchema: defaultSchema}
+	stmt, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedDDL, err)
+	}
+	return stmt, nil
+}
+
+type ddlParser struct {
+	sql           string
+	toks          []sqlToken
+	i             int
+	defaultSchema string
+}
+
+func (p *ddlParser) parse() (*DDLStatement, error) {
+	switch {
+	case p.accept("CREATE"):
+		return p.parseCreate()
+	case p.accept("ALTER"):
+		p.accept("ONLINE")
+		p.accept("IGNORE")
+		if !p.accept("TABLE") {
+			return &DDLStatement{Kind: DDLUnknown}, nil
+		}
+		return p.parseAlter()
+	case p.accept("DROP"):
+		return p.parseDrop()
+	case p.accept("RENAME"):
+		if !p.accept("TABLE") && !p.accept("TABLES") {
+			return &DDLStatement{Kind: DDLUnknown}, nil
+		}
+		return p.parseRename()
+	case p.accept("TRUNCATE"):
+		p.accept("TABLE")
+		table, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		return &DDLStatement{Kind: DDLTruncateTable, Tables: []TableName{table}}, nil
+	}
+	return &DDLStatement{Kind: DDLUnknown}, nil
+}
+
+func (p *ddlParser) parseCreate() (*DDLStatement, error) {
+	p.accept("OR", "REPLACE")
+	p.accept("TEMPORARY")
+	if p.accept("TABLE") {
+		p.accept("IF", "NOT", "EXISTS")
+		table, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		return &DDLStatement{Kind: DDLCreateTable, Tables: []TableName{table}}, nil
+	}
+
+	p.accept("ONLINE")
+	p.accept("OFFLINE")
+	if !p.accept("UNIQUE") && !p.accept("FULLTEXT") {
+		p.accept("SPATIAL")
+	}
+	if !p.accept("INDEX") {
+		return &DDLStatement{Kind: DDLUnknown}, nil
+	}
+	p.accept("IF", "NOT", "EXISTS")
+	index, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("USING") {
+		p.next()
+	}
+	if !p.accept("ON") {
+		return nil, p.unexpected("ON")
+	}
+	table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	return &DDLStatement{Kind: DDLCreateIndex, Tables: []TableName{table}, Index: index}, nil
+}
+
+func (p *ddlParser) parseDrop() (*DDLStatement, error) {
+	p.accept("ONLINE")
+	p.accept("OFFLINE")
+	if p.accept("INDEX") {
+		p.accept("IF", "EXISTS")
+		index, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept("ON") {
+			return nil, p.unexpected("ON")
+		}
+		table, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		return &DDLStatement{Kind: DDLDropIndex, Tables: []TableName{table}, Index: index}, nil
+	}
+
+	p.accept("TEMPORARY")
+	if !p.accept("TABLE") && !p.accept("TABLES") {
+		return &DDLStatement{Kind: DDLUnknown}, nil
+	}
+	p.accept("IF", "EXISTS")
+	stmt := &DDLStatement{Kind: DDLDropTable}
+	for {
+		table, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Tables = append(stmt.Tables, table)
+		if !p.acceptPunct(',') {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *ddlParser) parseRename() (*DDLStatement, error) {
+	stmt := &DDLStatement{Kind: DDLRenameTable}
+	for {
+		from, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept("TO") {
+			return nil, p.unexpected("TO")
+		}
+		to, err := p.tableName()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Tables = append(stmt.Tables, from, to)
+		stmt.Renames = append(stmt.Renames, TableRename{From: from, To: to})
+		if !p.acceptPunct(',') {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *ddlParser) parseAlter() (*DDLStatement, error) {
+	table, err := p.tableName()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &DDLStatement{Kind: DDLAlterTable, Tables: []TableName{table}}
+	for _, spec := range splitTopLevel(p.toks[p.i:]) {
+		if err := p.parseAlterSpec(stmt, table, spec); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// notColumns are the words following ADD, DROP, RENAME or ALTER in ALTER
+// TABLE specifications that are not about columns.
+var notColumns = []string{
+	"INDEX", "KEY", "PRIMARY", "UNIQUE", "FULLTEXT", "SPATIAL", "FOREIGN",
+	"CONSTRAINT", "CHECK", "PARTITION", "DEFAULT",
+}
+
+func (p *ddlParser) parseAlterSpec(stmt *DDLStatement, table TableName, spec []sqlToken) error {
+	sp := &ddlParser{sql: p.sql, toks: spec, defaultSchema: p.defaultSchema}
+	switch {
+	case sp.accept("ADD"):
+		column := sp.accept("COLUMN")
+		if !column && sp.peekKeyword(notColumns...) {
+			return nil
+		}
+		sp.accept("IF", "NOT", "EXISTS")
+		if sp.peek().isPunct('(') {
+			// ADD (a INT, b INT)
+			inner := spec[sp.i+1:]
+			if n := len(inner); n > 0 && inner[n-1].isPunct(')') {
+				inner = inner[:n-1]
+			}
+			for _, def := range splitTopLevel(inner) {
+				dp := &ddlParser{sql: p.sql, toks: def}
+				name, err := dp.identifier()
+				if err != nil {
+					return err
+				}
+				stmt.Columns = append(stmt.Columns, ColumnChange{Kind: ColumnAdded, Name: name, Definition: dp.rest()})
+			}
+			return nil
+		}
+		name, err := sp.identifier()
+		if err != nil {
+			return err
+		}
+		stmt.Columns = append(stmt.Columns, ColumnChange{Kind: ColumnAdded, Name: name, Definition: sp.rest()})
+
+	case sp.accept("DROP"):
+		if !sp.accept("COLUMN") && sp.peekKeyword(notColumns...) {
+			return nil
+		}
+		sp.accept("IF", "EXISTS")
+		name, err := sp.identifier()
+		if err != nil {
+			return err
+		}
+		stmt.Columns = append(stmt.Columns, ColumnChange{Kind: ColumnDropped, Name: name})
+
+	case sp.accept("CHANGE"):
+		sp.accept("COLUMN")
+		sp.accept("IF", "EXISTS")
+		oldName, err := sp.identifier()
+		if err != nil {
+			return err
+		}
+		name, err := sp.identifier()
+		if err != nil {
+			return err
+		}
+		change := ColumnChange{Kind: ColumnModified, Name: name, Definition: sp.rest()}
+		if !strings.EqualFold(oldName, name) {
+			change.Kind, change.OldName = ColumnRenamed, oldName
+		}
+		stmt.Columns = append(stmt.Columns, change)
+
+	case sp.accept("MODIFY"):
+		sp.accept("COLUMN")
+		sp.accept("IF", "EXISTS")
+		name, err := sp.identifier()
+		if err != nil {
+			return err
+		}
+		stmt.Columns = append(stmt.Columns, ColumnChange{Kind: ColumnModified, Name: name, Definition: sp.rest()})
+
+	case sp.accept("RENAME"):
+		if sp.accept("COLUMN") {
+			oldName, err := sp.identifier()
+			if err != nil {
+				return err
+			}
+			if !sp.accept("TO") {
+				return sp.unexpected("TO")
+			}
+			name, err := sp.identifier()
+			if err != nil {
+				return err
+			}
+			stmt.Columns = append(stmt.Columns, ColumnChange{Kind: ColumnRenamed, Name: name, OldName: oldName})
+			return nil
+		}
+		if sp.peekKeyword("INDEX", "KEY") {
+			return nil
+		}
+		if !sp.accept("TO") {
+			sp.accept("AS")
+		}
+		to, err := sp.tableName()
+		if err != nil {
+			return err
+		}
+		stmt.Tables = append(stmt.Tables, to)
+		stmt.Renames = append(stmt.Renames, TableRename{From: table, To: to})
+
+	case sp.accept("ALTER"):
+		if !sp.accept("COLUMN") && sp.peekKeyword("INDEX", "CHECK", "CONSTRAINT") {
+			return nil
+		}
+		name, err := sp.identifier()
+		if err != nil {
+			return err
+		}
+		stmt.Columns = append(stmt.Columns, ColumnChange{Kind: ColumnModified, Name: name, Definition: sp.rest()})
+	}
+	return nil
+}
+
+func (p *ddlParser) peek() sqlToken {
+	if p.i < len(p.toks) {
+		return p.toks[p.i]
+	}
+	return sqlToken{kind: tokEOF, pos: len(p.sql)}
+}
+
+func (p *ddlParser) next() sqlToken {
+	t := p.peek()
+	if p.i < len(p.toks) {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the keywords if they come next, all of them.
+func (p *ddlParser) accept(keywords ...string) bool {
+	if p.i+len(keywords) > len(p.toks) {
+		return false
+	}
+	for j, kw := range keywords {
+		if !p.toks[p.i+j].isKeyword(kw) {
+			return false
+		}
+	}
+	p.i += len(keywords)
+	return true
+}
+
+func (p *ddlParser) acceptPunct(c byte) bool {
+	if p.peek().isPunct(c) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *ddlParser) peekKeyword(keywords ...string) bool {
+	t := p.peek()
+	for _, kw := range keywords {
+		if t.isKeyword(kw) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ddlParser) identifier() (string, error) {
+	t := p.peek()
+	if t.kind != tokWord && t.kind != tokQuoted {
+		return "", p.unexpected("identifier")
+	}
+	p.i++
+	return t.text, nil
+}
+
+func (p *ddlParser) tableName() (TableName, error) {
+	name, err := p.identifier()
+	if err != nil {
+		return TableName{}, err
+	}
+	if !p.acceptPunct('.') {
+		return TableName{Schema: p.defaultSchema, Table: name}, nil
+	}
+	table, err := p.identifier()
+	if err != nil {
+		return TableName{}, err
+	}
+	return TableName{Schema: name, Table: table}, nil
+}
+
+// rest returns the SQL text of the remaining tokens.
+func (p *ddlParser) rest() string {
+	if p.i >= len(p.toks) {
+		return ""
+	}
+	return strings.TrimSpace(p.sql[p.toks[p.i].pos:p.toks[len(p.toks)-1].end])
+}
+
+func (p *ddlParser) unexpected(want string) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("expected %s, got end of statement", want)
+	}
+	return fmt.Errorf("expected %s at offset %d, got %q", want, t.pos, p.sql[t.pos:t.end])
+}
+
+// splitTopLevel splits toks at the commas outside of parentheses.
+func splitTopLevel(toks []sqlToken) [][]sqlToken {
+	var parts [][]sqlToken
+	depth, start := 0, 0
+	for i, t := range toks {
+		switch {
+		case t.isPunct('('):
+			depth++
+		case t.isPunct(')'):
+			depth--
+		case t.isPunct(',') && depth == 0:
+			parts = append(parts, toks[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(toks) {
+		parts = append(parts, toks[start:])
+	}
+	return parts
+}
+
+type sqlTokenKind int
+
+const (
+	tokEOF sqlTokenKind = iota
+	tokWord
+	// tokQuoted is a backquoted identifier.
+	tokQuoted
+	tokString
+	tokPunct
+)
+
+// sqlToken is a token of sql[pos:end]. The text of quoted identifiers is
+// unquoted.
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+	end  int
+}
+
+func (t sqlToken) isKeyword(kw string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, kw)
+}
+
+func (t sqlToken) isPunct(c byte) bool {
+	return t.kind == tokPunct && t.text[0] == c
+}
+
+// tokenizeSQL splits MySQL statements into tokens, dropping comments. The
+// content of executable comments, /*!50100 ... */, is kept.
+func tokenizeSQL(sql string) ([]sqlToken, error) {
+	var toks []sqlToken
+	inExecutable := false
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			i++
+
+		case c == '#' || isDashComment(sql[i:]):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				return toks, nil
+			}
+			i += end + 1
+
+		case strings.HasPrefix(sql[i:], "/*!") || strings.HasPrefix(sql[i:], "/*M!"):
+			i += strings.IndexByte(sql[i:], '!') + 1
+			for i < len(sql) && sql[i] >= '0' && sql[i] <= '9' {
+				i++
+			}
+			inExecutable = true
+
+		case c == '*' && inExecutable && strings.HasPrefix(sql[i:], "*/"):
+			i += 2
+			inExecutable = false
+
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at offset %d", i)
+			}
+			i += end + 4
+
+		case c == '`':
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(sql) {
+					return nil, fmt.Errorf("unterminated identifier at offset %d", i)
+				}
+				if sql[j] == '`' {
+					if j+1 < len(sql) && sql[j+1] == '`' {
+						b.WriteByte('`')
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(sql[j])
+				j++
+			}
+			toks = append(toks, sqlToken{kind: tokQuoted, text: b.String(), pos: i, end: j + 1})
+			i = j + 1
+
+		case c == '\'' || c == '"':
+			j := i + 1
+			for {
+				if j >= len(sql) {
+					return nil, fmt.Errorf("unterminated string at offset %d", i)
+				}
+				if sql[j] == '\\' {
+					j += 2
+					continue
+				}
+				if sql[j] == c {
+					if j+1 < len(sql) && sql[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			toks = append(toks, sqlToken{kind: tokString, text: sql[i : j+1], pos: i, end: j + 1})
+			i = j + 1
+
+		case isWordByte(c):
+			j := i
+			for j < len(sql) && isWordByte(sql[j]) {
+				j++
+			}
+			toks = append(toks, sqlToken{kind: tokWord, text: sql[i:j], pos: i, end: j})
+			i = j
+
+		default:
+			toks = append(toks, sqlToken{kind: tokPunct, text: sql[i : i+1], pos: i, end: i + 1})
+			i++
+		}
+	}
+	return toks, nil
+}
+
+// isDashComment reports whether s starts with a -- comment, which needs
+// whitespace after the dashes.
+func isDashComment(s string) bool {
+	return strings.HasPrefix(s, "--") && (len(s) == 2 || s[2] <= ' ')
+}
+
+// isWordByte reports whether c may be part of an unquoted identifier or
+// keyword. Bytes of multi-byte UTF-8 sequences all are.
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
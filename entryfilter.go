@@ -0,0 +1,175 @@
+package canal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/katakurin/canal/protobuf/entry"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// EntryFilter selects entries from their header alone, so that the entries
+// it drops are never fully unmarshaled. Installed with WithEntryFilter, it
+// keeps the dropped entries out of Message.Entries or Message.RawEntries;
+// the batch still covers them, acking it acks them too.
+//
+// The zero EntryFilter selects everything; every condition set narrows it.
+type EntryFilter struct {
+	// Tables selects entries by schema.table. Entries without a table, such
+	// as transaction boundaries, pass.
+	Tables *Filter
+	// EntryTypes lists the entry types to keep, all of them when empty.
+	EntryTypes []entry.EntryType
+	// EventTypes lists the event types of the ROWDATA entries to keep, all
+	// of them when empty. Other entries are not checked.
+	EventTypes []entry.EventType
+	// Since and Until bound the execute time of the entries to keep, Since
+	// included and Until excluded. Zero times leave the range open.
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether the filter keeps e.
+func (f *EntryFilter) Match(e *entry.Entry) bool {
+	header := e.GetHeader()
+	return f.match(entryHeader{
+		entryType:   e.GetEntryType(),
+		eventType:   header.GetEventType(),
+		executeTime: header.GetExecuteTime(),
+		schema:      header.GetSchemaName(),
+		table:       header.GetTableName(),
+	})
+}
+
+// MatchRaw reports whether the filter keeps the marshaled entry raw, only
+// decoding its header. Errors wrap ErrCorruptMessage.
+func (f *EntryFilter) MatchRaw(raw []byte) (bool, error) {
+	h, err := peekEntryHeader(raw)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrCorruptMessage, err)
+	}
+	return f.match(h), nil
+}
+
+func (f *EntryFilter) match(h entryHeader) bool {
+	if len(f.EntryTypes) > 0 && !hasEntryType(f.EntryTypes, h.entryType) {
+		return false
+	}
+	if len(f.EventTypes) > 0 && h.entryType == entry.EntryType_ROWDATA && !hasEventType(f.EventTypes, h.eventType) {
+		return false
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		t := fromMillis(h.executeTime)
+		if !f.Since.IsZero() && t.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && !t.Before(f.Until) {
+			return false
+		}
+	}
+	if f.Tables != nil && !f.Tables.Matches(h.schema, h.table) {
+		return false
+	}
+	return true
+}
+
+func hasEntryType(types []entry.EntryType, t entry.EntryType) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func hasEventType(types []entry.EventType, t entry.EventType) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// entryHeader holds the fields of an entry an EntryFilter looks at.
+type entryHeader struct {
+	entryType   entry.EntryType
+	eventType   entry.EventType
+	executeTime int64
+	schema      string
+	table       string
+}
+
+// Field numbers of entry.Entry and entry.Header.
+const (
+	entryHeaderField  = 1
+	entryTypeField    = 2
+	headerExecuteTime = 6
+	headerSchemaName  = 8
+	headerTableName   = 9
+	headerEventType   = 11
+)
+
+// peekEntryHeader decodes the header fields of a marshaled entry.Entry,
+// skipping the store value and everything else.
+func peekEntryHeader(raw []byte) (entryHeader, error) {
+	var h entryHeader
+	err := walkFields(raw, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == entryHeaderField && typ == protowire.BytesType:
+			b, n := protowire.ConsumeBytes(value)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			// Like proto.Unmarshal, a repeated header merges into the first.
+			return peekHeader(&h, b)
+		case num == entryTypeField && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			h.entryType = entry.EntryType(v)
+		}
+		return nil
+	})
+	return h, err
+}
+
+func peekHeader(h *entryHeader, raw []byte) error {
+	return walkFields(raw, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == headerExecuteTime && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			h.executeTime = int64(v)
+		case num == headerSchemaName && typ == protowire.BytesType:
+			b, _ := protowire.ConsumeBytes(value)
+			h.schema = string(b)
+		case num == headerTableName && typ == protowire.BytesType:
+			b, _ := protowire.ConsumeBytes(value)
+			h.table = string(b)
+		case num == headerEventType && typ == protowire.VarintType:
+			v, _ := protowire.ConsumeVarint(value)
+			h.eventType = entry.EventType(v)
+		}
+		return nil
+	})
+}
+
+// walkFields calls fn with every field of the marshaled message raw, value
+// being the encoded field value, already checked to be well-formed.
+func walkFields(raw []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		raw = raw[n:]
+		n = protowire.ConsumeFieldValue(num, typ, raw)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, typ, raw[:n]); err != nil {
+			return err
+		}
+		raw = raw[n:]
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package canal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/katakurin/canal/protobuf/protocol"
+)
+
+// Sentinel errors a *ServerError matches with errors.Is, depending on the
+// failure the server reported.
+var (
+	ErrAuthFailed          = errors.New("authentication failed")
+	ErrDestinationNotFound = errors.New("destination not found or not started")
+	ErrClientRunning       = errors.New("client is already running")
+	ErrNotSubscribed       = errors.New("client is not subscribed")
+	ErrInvalidBatch        = errors.New("invalid batch id")
+	ErrCorruptMessage      = errors.New("corrupt message")
+)
+
+// ServerError is a failure reported by the canal server in an Ack packet.
+type ServerError struct {
+	// Op is the client operation that failed, e.g. "auth" or "subscribe".
+	Op      string
+	Code    int32
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("canal %s failed with code %d: %s", e.Op, e.Code, e.Message)
+}
+
+// serverErrorKinds maps fragments of the messages of the Java canal server to
+// the sentinel they stand for. The first fragment found in a message wins, so
+// that "batchId:1 is not exist" is not taken for a missing destination.
+var serverErrorKinds = []struct {
+	fragment string
+	kind     error
+}{
+	{"auth failed", ErrAuthFailed},
+	{"batchid", ErrInvalidBatch},
+	{"should start first", ErrDestinationNotFound},
+	{"is not exist", ErrDestinationNotFound},
+	{"is running", ErrClientRunning},
+	{"should subscribe first", ErrNotSubscribed},
+}
+
+// Is matches the sentinel the message of the server maps to, whatever the
+// operation: a destination missing when authenticating is not an
+// authentication failure.
+func (e *ServerError) Is(target error) bool {
+	msg := strings.ToLower(e.Message)
+	for _, k := range serverErrorKinds {
+		if strings.Contains(msg, k.fragment) {
+			return k.kind == target
+		}
+	}
+	return false
+}
+
+func newServerError(op string, ack *protocol.Ack) error {
+	if ack.GetErrorCode() <= 0 {
+		return nil
+	}
+	return &ServerError{
+		Op:      op,
+		Code:    ack.GetErrorCode(),
+		Message: ack.GetErrorMessage(),
+	}
+}
+
+// OpError wraps a transport failure with the operation and server address.
+type OpError struct {
+	Op   string
+	Addr string
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("canal %s %s: %v", e.Op, e.Addr, e.Err)
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the underlying error is a timeout.
+func (e *OpError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// IsRetryable tells whether the operation that returned err may succeed when
+// tried again, possibly after reconnecting: transport failures, a broken
+// connection, a destination that is not running yet, or another client still
+// holding it. Failed authentication, protocol violations and cancellation are
+// final.
+func IsRetryable(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrClientClosed):
+		return false
+	case errors.Is(err, ErrConnectionBroken), errors.Is(err, ErrDestinationNotFound),
+		errors.Is(err, ErrClientRunning), errors.Is(err, ErrNoRunningServer):
+		return true
+	}
+
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,131 @@
+package canal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/katakurin/canal/protobuf/entry"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrWrongEntryType = errors.New("entry is not of the requested type")
+)
+
+// EntryError reports a failure about one entry of a batch.
+type EntryError struct {
+	// BatchID is the batch a Get failed to decode the entry of, zero when
+	// the entry comes from a Message already returned. The batch is not
+	// acked: servers expect acks in order, so ack or roll it back.
+	BatchID int64
+	// Index is the position of the entry in Message.Entries, or in
+	// Message.RawEntries, once entries dropped by an EntryFilter are left
+	// out.
+	Index int
+	Err   error
+}
+
+func (e *EntryError) Error() string {
+	if e.BatchID > 0 {
+		return fmt.Sprintf("batch %d entry %d: %v", e.BatchID, e.Index, e.Err)
+	}
+	return fmt.Sprintf("entry %d: %v", e.Index, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// Event is the decoded view of one entry of a Message. The payload the entry
+// carries is only unmarshaled when asked for, and then kept. An Event is not
+// safe for concurrent use.
+type Event struct {
+	Index  int
+	Header *entry.Header
+	Type   entry.EntryType
+	Entry  *entry.Entry
+
+	payload proto.Message
+	err     error
+}
+
+func newEvent(index int, e *entry.Entry) *Event {
+	return &Event{
+		Index:  index,
+		Header: e.GetHeader(),
+		Type:   e.GetEntryType(),
+		Entry:  e,
+	}
+}
+
+// Events returns the events of the message in order. Entries of a lazily
+// parsed message are unmarshaled on the way; the first one failing to is
+// reported with an *EntryError.
+func (m *Message) Events() ([]*Event, error) {
+	events := make([]*Event, 0, m.Len())
+	if !m.Raw {
+		for i, e := range m.Entries {
+			events = append(events, newEvent(i, e))
+		}
+		return events, nil
+	}
+	for i, raw := range m.RawEntries {
+		e, err := unmarshalEntry(i, raw)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, newEvent(i, e))
+	}
+	return events, nil
+}
+
+// RowChange returns the row changes of a ROWDATA entry.
+func (e *Event) RowChange() (*entry.RowChange, error) {
+	v, err := e.decode(entry.EntryType_ROWDATA, func() proto.Message { return &entry.RowChange{} })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*entry.RowChange), nil
+}
+
+// TransactionBegin returns the payload of a TRANSACTIONBEGIN entry.
+func (e *Event) TransactionBegin() (*entry.TransactionBegin, error) {
+	v, err := e.decode(entry.EntryType_TRANSACTIONBEGIN, func() proto.Message { return &entry.TransactionBegin{} })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*entry.TransactionBegin), nil
+}
+
+// TransactionEnd returns the payload of a TRANSACTIONEND entry.
+func (e *Event) TransactionEnd() (*entry.TransactionEnd, error) {
+	v, err := e.decode(entry.EntryType_TRANSACTIONEND, func() proto.Message { return &entry.TransactionEnd{} })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*entry.TransactionEnd), nil
+}
+
+func (e *Event) decode(want entry.EntryType, alloc func() proto.Message) (proto.Message, error) {
+	if e.Type != want {
+		return nil, &EntryError{Index: e.Index, Err: fmt.Errorf("%w: %v is not %v", ErrWrongEntryType, e.Type, want)}
+	}
+	if e.payload == nil && e.err == nil {
+		v := alloc()
+		if err := proto.Unmarshal(e.Entry.GetStoreValue(), v); err != nil {
+			e.err = &EntryError{Index: e.Index, Err: fmt.Errorf("%w: %v", ErrCorruptMessage, err)}
+		} else {
+			e.payload = v
+		}
+	}
+	return e.payload, e.err
+}
+
+func unmarshalEntry(index int, raw []byte) (*entry.Entry, error) {
+	e := &entry.Entry{}
+	if err := proto.Unmarshal(raw, e); err != nil {
+		return nil, &EntryError{Index: index, Err: fmt.Errorf("%w: %v", ErrCorruptMessage, err)}
+	}
+	return e, nil
+}
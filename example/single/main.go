@@ -1,10 +1,11 @@
 package main
 
 import (
-	"time"
+	"context"
+	"os"
+	"os/signal"
 
 	"github.com/katakurin/canal/protobuf/entry"
-	"google.golang.org/protobuf/proto"
 
 	"github.com/katakurin/canal"
 	log "github.com/sirupsen/logrus"
@@ -15,35 +16,37 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = connector.Subscribe(".*\\\\..*")
+	defer connector.Disconnect()
+	err = connector.Subscribe(".*\\..*")
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	// 读取canal
-	go func() {
-		for {
-			message, err := connector.GetWithOutAck(10, -1)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			batchID := message.ID
-			if batchID == -1 || len(message.Entries) <= 0 {
-				time.Sleep(1000 * time.Millisecond)
+	consumer := canal.NewConsumer(connector, canal.WithBatchSize(10))
+	err = consumer.Run(ctx, canal.HandlerFunc(func(ctx context.Context, message *canal.Message) error {
+		log.Info(message.ID)
+		events, err := message.Events()
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			log.Info(event.Entry.String())
+			if event.Type != entry.EntryType_ROWDATA {
 				continue
 			}
-			log.Info(message.ID)
-			if !message.Raw {
-				for _, v := range message.Entries {
-					log.Info(v.String())
-					change := entry.RowChange{}
-					proto.Unmarshal(v.GetStoreValue(), &change)
-					log.Info(change.String())
-				}
+			change, err := event.RowChange()
+			if err != nil {
+				return err
 			}
-
+			log.Info(change.String())
 		}
-	}()
-
-	select {}
+		return nil
+	}))
+	if err != nil {
+		log.Fatal(err)
+	}
 }
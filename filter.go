@@ -0,0 +1,157 @@
+package canal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+var (
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// Filter is a canal table filter, as given to Subscribe or set as
+// canal.instance.filter.regex and canal.instance.filter.black.regex on the
+// server: a comma separated list of regular expressions, each matched
+// against the whole schema.table name of an entry, ignoring case. Entries
+// without a table, such as transaction boundaries, always pass.
+//
+// The server evaluates filters with Perl 5 regular expressions. Those using
+// what Go lacks, like lookarounds and backreferences, do not parse here.
+type Filter struct {
+	expr     string
+	patterns []*regexp.Regexp
+	black    bool
+}
+
+// ParseFilter parses a filter selecting the tables it matches. The empty
+// filter selects every table.
+func ParseFilter(filter string) (*Filter, error) {
+	return parseFilter(filter, false)
+}
+
+// ParseBlackFilter parses a filter selecting the tables it does not match.
+// The empty filter selects every table.
+func ParseBlackFilter(filter string) (*Filter, error) {
+	return parseFilter(filter, true)
+}
+
+func parseFilter(filter string, black bool) (*Filter, error) {
+	f := &Filter{expr: filter, black: black}
+	for _, p := range splitFilter(filter) {
+		re, err := regexp.Compile("(?i)^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%w: pattern %q: %v", ErrInvalidFilter, p, err)
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	return f, nil
+}
+
+func splitFilter(filter string) []string {
+	var patterns []string
+	for _, p := range strings.Split(filter, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// Matches reports whether the entries of schema.table pass the filter.
+func (f *Filter) Matches(schema, table string) bool {
+	if len(f.patterns) == 0 || table == "" {
+		return true
+	}
+	name := schema + "." + table
+	for _, re := range f.patterns {
+		if re.MatchString(name) {
+			return !f.black
+		}
+	}
+	return f.black
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// ValidateFilter checks that filter parses, and catches patterns that parse
+// but cannot be what was meant:
+//
+//   - a plain name without a dot, like "orders", which matches no
+//     schema.table name;
+//   - a literal backslash, like in ".*\\..*", usually an escape escaped
+//     twice over.
+//
+// Errors wrap ErrInvalidFilter.
+func ValidateFilter(filter string) error {
+	if _, err := ParseFilter(filter); err != nil {
+		return err
+	}
+	for _, p := range splitFilter(filter) {
+		re, err := syntax.Parse(p, syntax.Perl)
+		if err != nil {
+			return fmt.Errorf("%w: pattern %q: %v", ErrInvalidFilter, p, err)
+		}
+		re = re.Simplify()
+		if re.Op == syntax.OpLiteral && !strings.ContainsRune(string(re.Rune), '.') {
+			return fmt.Errorf("%w: pattern %q matches no schema.table name", ErrInvalidFilter, p)
+		}
+		if hasLiteralBackslash(re) {
+			return fmt.Errorf("%w: pattern %q matches a literal backslash, is it escaped twice?", ErrInvalidFilter, p)
+		}
+	}
+	return nil
+}
+
+func hasLiteralBackslash(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpLiteral && strings.ContainsRune(string(re.Rune), '\\') {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if hasLiteralBackslash(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterBuilder builds a filter from plain schema and table names, escaping
+// them so that they only match themselves.
+type FilterBuilder struct {
+	patterns []string
+}
+
+func NewFilterBuilder() *FilterBuilder {
+	return &FilterBuilder{}
+}
+
+// Schema adds every table of schema.
+func (b *FilterBuilder) Schema(schema string) *FilterBuilder {
+	b.patterns = append(b.patterns, quoteName(schema)+`\..*`)
+	return b
+}
+
+// Tables adds the tables of schema.
+func (b *FilterBuilder) Tables(schema string, tables ...string) *FilterBuilder {
+	for _, table := range tables {
+		b.patterns = append(b.patterns, quoteName(schema)+`\.`+quoteName(table))
+	}
+	return b
+}
+
+// String returns the filter, empty when nothing was added.
+func (b *FilterBuilder) String() string {
+	return strings.Join(b.patterns, ",")
+}
+
+// quoteName escapes a name for use in a filter. Commas separate patterns and
+// spaces around them are trimmed, so both are written as hex escapes.
+func quoteName(name string) string {
+	quoted := regexp.QuoteMeta(name)
+	quoted = strings.ReplaceAll(quoted, ",", `\x2c`)
+	return strings.ReplaceAll(quoted, " ", `\x20`)
+}
@@ -3,6 +3,8 @@ module github.com/katakurin/canal
 go 1.16
 
 require (
-	github.com/sirupsen/logrus v1.8.1 // indirect
+	github.com/go-zookeeper/zk v1.0.3
+	github.com/sirupsen/logrus v1.8.1
 	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,198 @@
+package canal
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/katakurin/canal/protobuf/protocol"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// heartbeat watches the liveness of the connection of a Client. An idle
+// connection is left to TCP keepalives, and an exchange that outlives the
+// time the server may legitimately take counts as a missed beat.
+type heartbeat struct {
+	interval  time.Duration
+	maxMissed int
+
+	mu        sync.Mutex
+	conn      net.Conn
+	busy      bool
+	busySince time.Time
+	busyWait  time.Duration
+	missed    int
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newHeartbeat(interval time.Duration, maxMissed int) *heartbeat {
+	if maxMissed <= 0 {
+		maxMissed = 1
+	}
+	return &heartbeat{
+		interval:  interval,
+		maxMissed: maxMissed,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// setConn watches conn from now on. TCP connections get keepalive probes
+// every interval, so that the kernel notices a dead peer on its own.
+func (h *heartbeat) setConn(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetKeepAlive(true)
+		_ = tcp.SetKeepAlivePeriod(h.interval)
+	}
+	h.mu.Lock()
+	h.conn = conn
+	h.missed = 0
+	h.mu.Unlock()
+}
+
+func (h *heartbeat) enter(wait time.Duration) {
+	h.mu.Lock()
+	h.busy = true
+	h.busySince = time.Now()
+	h.busyWait = wait
+	h.missed = 0
+	h.mu.Unlock()
+}
+
+func (h *heartbeat) leave() {
+	h.mu.Lock()
+	h.busy = false
+	h.mu.Unlock()
+}
+
+// overdue counts a missed beat when the exchange in flight, if any, has taken
+// longer than expected. When too many beats have been missed it closes the
+// connection, so that the pending exchange fails instead of hanging on a
+// half-open connection, and tells so.
+func (h *heartbeat) overdue() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.busy || h.conn == nil || h.missed >= h.maxMissed {
+		return false
+	}
+	if time.Since(h.busySince) <= h.busyWait+time.Duration(h.missed+1)*h.interval {
+		return false
+	}
+	h.missed++
+	if h.missed < h.maxMissed {
+		return false
+	}
+	_ = h.conn.Close()
+	return true
+}
+
+func (c *Client) startHeartbeat() {
+	if c.opts.heartbeatInterval <= 0 {
+		return
+	}
+	c.hb = newHeartbeat(c.opts.heartbeatInterval, c.opts.heartbeatMaxMissed)
+	c.hb.setConn(c.netConn)
+	go c.heartbeatLoop(c.hb)
+}
+
+// stopHeartbeat stops the heartbeat loop. It may be called more than once.
+func (c *Client) stopHeartbeat() {
+	if c.hb == nil {
+		return
+	}
+	c.hb.stopOnce.Do(func() { close(c.hb.stop) })
+}
+
+func (c *Client) heartbeatLoop(h *heartbeat) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		if h.overdue() {
+			c.log.Error("too many heartbeats missed, marking connection broken", F("missed", h.maxMissed))
+			c.markBroken()
+		}
+	}
+}
+
+// RTT returns the round-trip time of the last exchange the server answers
+// right away: the authentication, a subscription, a Get with a negative
+// timeout or a Ping. Long polling Gets are not measured, the server holds
+// them on purpose.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// observeRTT records the round trip of an exchange started at start.
+func (c *Client) observeRTT(start time.Time) time.Duration {
+	rtt := time.Since(start)
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	return rtt
+}
+
+func (c *Client) Ping() (time.Duration, error) {
+	return c.PingContext(context.Background())
+}
+
+// PingContext sends a HEARTBEAT packet and waits for the server to answer it.
+// Stock canal servers do not support it: the Java server, like canaltest,
+// replies with an error and hangs up, so the error is returned and the
+// connection marked broken. Only ping servers known to answer heartbeats,
+// like package server; RTT is measured without pinging anyway.
+func (c *Client) PingContext(ctx context.Context) (time.Duration, error) {
+	c.lock(0)
+	defer c.unlock()
+
+	if err := c.ensureConnected(ctx); err != nil {
+		return 0, err
+	}
+	end := c.bindContext(ctx)
+	rtt, err := c.ping()
+	return rtt, end(err)
+}
+
+func (c *Client) ping() (time.Duration, error) {
+	start := time.Now()
+	packet := &protocol.Packet{}
+	heartBeat := &protocol.HeartBeat{
+		SendTimestamp: toMillis(start),
+	}
+	packet.Type = protocol.PacketType_HEARTBEAT
+	packet.Body, _ = proto.Marshal(heartBeat)
+
+	if err := c.writePacket(packet); err != nil {
+		return 0, err
+	}
+	if err := c.readPacket(packet); err != nil {
+		return 0, err
+	}
+	switch packet.GetType() {
+	case protocol.PacketType_HEARTBEAT:
+		return c.observeRTT(start), nil
+	case protocol.PacketType_ACK:
+		// The server does not implement heartbeats and hangs up.
+		c.markBroken()
+		var ack protocol.Ack
+		if proto.Unmarshal(packet.GetBody(), &ack) == nil {
+			if err := newServerError("ping", &ack); err != nil {
+				return 0, err
+			}
+		}
+		return 0, ErrUnexpectedPacket
+	default:
+		c.markBroken()
+		return 0, ErrUnexpectedPacket
+	}
+}
@@ -0,0 +1,59 @@
+package canal
+
+// Field is a key/value pair attached to a log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger is the leveled, structured logger the client reports protocol steps
+// to. Adapters for logrus and log/slog are provided.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Info(string, ...Field)  {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+
+// NopLogger returns a Logger that discards everything, the default.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+// fieldLogger prepends a fixed set of fields to every entry.
+type fieldLogger struct {
+	logger Logger
+	fields []Field
+}
+
+func withFields(logger Logger, fields ...Field) Logger {
+	if logger == nil {
+		return NopLogger()
+	}
+	if _, ok := logger.(nopLogger); ok {
+		return logger
+	}
+	return &fieldLogger{logger: logger, fields: fields}
+}
+
+func (l *fieldLogger) with(fields []Field) []Field {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	return append(all, fields...)
+}
+
+func (l *fieldLogger) Debug(msg string, fields ...Field) { l.logger.Debug(msg, l.with(fields)...) }
+func (l *fieldLogger) Info(msg string, fields ...Field)  { l.logger.Info(msg, l.with(fields)...) }
+func (l *fieldLogger) Warn(msg string, fields ...Field)  { l.logger.Warn(msg, l.with(fields)...) }
+func (l *fieldLogger) Error(msg string, fields ...Field) { l.logger.Error(msg, l.with(fields)...) }
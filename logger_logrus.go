@@ -0,0 +1,30 @@
+package canal
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+// NewLogrusLogger adapts a logrus logger or entry to Logger.
+func NewLogrusLogger(logger logrus.FieldLogger) Logger {
+	return &logrusLogger{logger: logger}
+}
+
+func (l *logrusLogger) entry(fields []Field) logrus.FieldLogger {
+	if len(fields) == 0 {
+		return l.logger
+	}
+	data := make(logrus.Fields, len(fields))
+	for _, f := range fields {
+		data[f.Key] = f.Value
+	}
+	return l.logger.WithFields(data)
+}
+
+func (l *logrusLogger) Debug(msg string, fields ...Field) { l.entry(fields).Debug(msg) }
+func (l *logrusLogger) Info(msg string, fields ...Field)  { l.entry(fields).Info(msg) }
+func (l *logrusLogger) Warn(msg string, fields ...Field)  { l.entry(fields).Warn(msg) }
+func (l *logrusLogger) Error(msg string, fields ...Field) { l.entry(fields).Error(msg) }
@@ -0,0 +1,30 @@
+//go:build go1.21
+// +build go1.21
+
+package canal_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/katakurin/canal"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := canal.NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	logger.Debug("filtered out", canal.F("batchId", 1))
+	logger.Warn("connection broken", canal.F("addr", "127.0.0.1:11111"), canal.F("attempt", 2))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v in %q, want a single entry", err, buf.String())
+	}
+	if entry["level"] != "WARN" || entry["msg"] != "connection broken" ||
+		entry["addr"] != "127.0.0.1:11111" || entry["attempt"] != float64(2) {
+		t.Fatalf("slog got %v", entry)
+	}
+}
@@ -12,42 +12,67 @@ import (
 
 type Message struct {
 	ID         int64
-	Entries    []entry.Entry
+	Entries    []*entry.Entry
 	Raw        bool
 	RawEntries [][]byte
 }
 
+// Len returns the number of entries in the message, parsed or not.
+func (m *Message) Len() int {
+	if m.Raw {
+		return len(m.RawEntries)
+	}
+	return len(m.Entries)
+}
+
 func ParseMessage(p *protocol.Packet, lazyParseEntry bool) (*Message, error) {
+	return decodeMessage(p, lazyParseEntry, nil, protocol.DefaultMaxFrameSize)
+}
+
+// decodeMessage is ParseMessage dropping the entries filter does not keep
+// before unmarshaling them, and failing with protocol.ErrFrameTooLarge when
+// the body decompresses to more than maxBody bytes.
+func decodeMessage(p *protocol.Packet, lazyParseEntry bool, filter *EntryFilter, maxBody int) (*Message, error) {
 	if p == nil {
 		return nil, nil
 	}
 	switch p.GetType() {
 	case protocol.PacketType_MESSAGES:
-		fmt.Println(p.GetCompression())
-		if p.GetCompression() != protocol.Compression_NONE && p.GetCompression() != protocol.Compression_COMPRESSIONCOMPATIBLEPROTO2 {
-			return nil, errors.New("compression is not supported in this connector")
+		body, err := p.DecompressBodyLimit(maxBody)
+		if errors.Is(err, protocol.ErrFrameTooLarge) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptMessage, err)
 		}
 
 		var messages protocol.Messages
-		if err := proto.Unmarshal(p.GetBody(), &messages); err != nil {
-			return nil, fmt.Errorf("something goes wrong with reason: %v", err)
+		if err := proto.Unmarshal(body, &messages); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptMessage, err)
 		}
 
 		message := &Message{
 			ID: messages.GetBatchId(),
 		}
 
+		raw := messages.GetMessages()
+		if filter != nil {
+			raw, err = filterEntries(raw, filter)
+			if err != nil {
+				return nil, inBatch(err, message.ID)
+			}
+		}
 		if lazyParseEntry {
 			message.Raw = true
-			message.RawEntries = messages.GetMessages()
+			message.RawEntries = raw
 		} else {
-			entries := make([]entry.Entry, 0, len(messages.GetMessages()))
-			for _, v := range messages.GetMessages() {
-				var entry entry.Entry
-				if err := proto.Unmarshal(v, &entry); err != nil {
-					return nil, fmt.Errorf("something goes wrong with reason: %v", err)
+			entries := make([]*entry.Entry, 0, len(raw))
+			for i, v := range raw {
+				e, err := unmarshalEntry(i, v)
+				if err != nil {
+					return nil, inBatch(err, message.ID)
 				}
-				entries = append(entries, entry)
+				entries = append(entries, e)
 			}
 			message.Raw = false
 			message.Entries = entries
@@ -56,10 +81,36 @@ func ParseMessage(p *protocol.Packet, lazyParseEntry bool) (*Message, error) {
 	case protocol.PacketType_ACK:
 		var ack protocol.Ack
 		if err := proto.Unmarshal(p.GetBody(), &ack); err != nil {
-			return nil, fmt.Errorf("something goes wrong with reason: %v", err)
+			return nil, fmt.Errorf("%w: %v", ErrCorruptMessage, err)
 		}
-		return nil, fmt.Errorf("something goes wrong with reason: %s", ack.GetErrorMessage())
+		return nil, &ServerError{Op: "get", Code: ack.GetErrorCode(), Message: ack.GetErrorMessage()}
 	default:
-		return nil, fmt.Errorf("unexpected packet type: %d", p.GetType())
+		return nil, fmt.Errorf("%w: %v", ErrUnexpectedPacket, p.GetType())
+	}
+}
+
+// filterEntries returns the marshaled entries filter keeps, reusing the
+// backing array of raw. An entry failing to decode is reported at the index
+// it would have had in the message, like entries failing afterwards.
+func filterEntries(raw [][]byte, filter *EntryFilter) ([][]byte, error) {
+	kept := raw[:0]
+	for _, v := range raw {
+		ok, err := filter.MatchRaw(v)
+		if err != nil {
+			return nil, &EntryError{Index: len(kept), Err: err}
+		}
+		if ok {
+			kept = append(kept, v)
+		}
+	}
+	return kept, nil
+}
+
+// inBatch records on the *EntryError err the batch its entry belongs to.
+func inBatch(err error, batchID int64) error {
+	var entryErr *EntryError
+	if errors.As(err, &entryErr) {
+		entryErr.BatchID = batchID
 	}
+	return err
 }
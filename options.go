@@ -1,25 +1,80 @@
 package canal
 
 import (
+	"context"
+	"net"
 	"time"
+
+	"github.com/katakurin/canal/protobuf/protocol"
 )
 
 type clientOptions struct {
 	clientID             int
 	username             string
 	password             string
+	dialer               Dialer
 	dialTimeout          time.Duration
 	readTimeout          time.Duration
 	writeTimeout         time.Duration
 	lazyParseEntry       bool
 	rollbackOnConnect    bool
 	rollbackOnDisConnect bool
+	reconnect            *Backoff
+	startTimestamp       time.Time
+	logger               Logger
+	heartbeatInterval    time.Duration
+	heartbeatMaxMissed   int
+	clusterRetryTimes    int
+	clusterRetryInterval time.Duration
+	maxFrameSize         int
+	entryFilter          *EntryFilter
 }
 
 func defaultClientOptions() clientOptions {
 	return clientOptions{
-		dialTimeout: 5 * time.Second,
+		clientID:             1001,
+		logger:               NopLogger(),
+		dialTimeout:          5 * time.Second,
+		clusterRetryTimes:    3,
+		clusterRetryInterval: 5 * time.Second,
+		maxFrameSize:         protocol.DefaultMaxFrameSize,
+	}
+}
+
+// Dialer opens the connection to a canal server. *net.Dialer satisfies it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Backoff is the exponential backoff applied between reconnect attempts.
+type Backoff struct {
+	// Initial is the delay before the second attempt.
+	Initial time.Duration
+	// Max caps the delay between two attempts.
+	Max time.Duration
+	// Multiplier grows the delay after every failed attempt.
+	Multiplier float64
+	// MaxRetries bounds the number of attempts, zero means retry forever.
+	MaxRetries int
+}
+
+// DefaultBackoff is a reasonable reconnect policy for most deployments.
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	MaxRetries: 0,
+}
+
+func (b Backoff) delay(retry int) time.Duration {
+	d := float64(b.Initial)
+	for i := 0; i < retry; i++ {
+		d *= b.Multiplier
+		if b.Max > 0 && d > float64(b.Max) {
+			return b.Max
+		}
 	}
+	return time.Duration(d)
 }
 
 // ClientOption .
@@ -41,8 +96,149 @@ func newFuncDialOption(f func(*clientOptions)) *funcClientOption {
 	}
 }
 
+// WithCredentials sets the username and password used to authenticate
+// against the canal server.
+func WithCredentials(username, password string) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.username = username
+		o.password = password
+	})
+}
+
+// WithClientID sets the client ID the server tracks the cursor for. It
+// defaults to 1001.
+func WithClientID(clientID int) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.clientID = clientID
+	})
+}
+
+// WithDialer replaces the default net.Dialer, e.g. to go through a proxy or
+// to use TLS.
+func WithDialer(dialer Dialer) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.dialer = dialer
+	})
+}
+
+// WithDialTimeout bounds how long establishing the connection may take.
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.dialTimeout = timeout
+	})
+}
+
+// WithReadTimeout bounds every read from the server. Reads answering a Get
+// get the Get timeout on top of it. It is a client socket deadline only: the
+// NetReadTimeout of ClientAuth is the idle timeout after which the server
+// drops the client, and is left to the server default.
+func WithReadTimeout(timeout time.Duration) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.readTimeout = timeout
+	})
+}
+
+// WithWriteTimeout bounds every write to the server, as a client socket
+// deadline only.
+func WithWriteTimeout(timeout time.Duration) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.writeTimeout = timeout
+	})
+}
+
+// WithMaxFrameSize bounds the size of the packets read from the server, and
+// of their bodies once decompressed, protocol.DefaultMaxFrameSize by default.
+// Larger packets fail with protocol.ErrFrameTooLarge. Zero or less lifts the
+// limit.
+func WithMaxFrameSize(n int) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.maxFrameSize = n
+	})
+}
+
+// WithRollbackOnDisconnect rolls back every unacked batch when the client is
+// disconnected.
+func WithRollbackOnDisconnect() ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.rollbackOnDisConnect = true
+	})
+}
+
+// WithEntryFilter drops the entries of every batch f does not keep, looking
+// at their header only. It cuts the cost of destinations carrying many
+// changes the client has no use for, especially with EnableLazyParseEntry.
+func WithEntryFilter(f EntryFilter) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.entryFilter = &f
+	})
+}
+
 func EnableLazyParseEntry() ClientOption {
 	return newFuncDialOption(func(o *clientOptions) {
 		o.lazyParseEntry = true
 	})
 }
+
+// WithClusterRetry sets how many times a ClusterClient retries a failed call
+// on a freshly resolved server, and how long it waits between attempts.
+func WithClusterRetry(times int, interval time.Duration) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.clusterRetryTimes = times
+		o.clusterRetryInterval = interval
+	})
+}
+
+// WithReconnect makes the client redial a broken connection on its next call,
+// redoing the handshake and the last subscription.
+func WithReconnect(b Backoff) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.reconnect = &b
+	})
+}
+
+// WithRollbackOnConnect rolls back every unacked batch after reconnecting so
+// that the server redelivers them.
+func WithRollbackOnConnect() ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.rollbackOnConnect = true
+	})
+}
+
+// WithHeartbeat detects half-open connections without any server support,
+// since the Java server hangs up on HEARTBEAT packets. An exchange still
+// pending maxMissed intervals after the time the server may legitimately
+// hold it gets its connection closed and marked broken, to be redialed with
+// WithReconnect. An idle connection is only probed with TCP keepalives every
+// interval: the operating system decides how many probes may go unanswered,
+// and the next call fails once it gave up on the connection.
+func WithHeartbeat(interval time.Duration, maxMissed int) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.heartbeatInterval = interval
+		o.heartbeatMaxMissed = maxMissed
+	})
+}
+
+// WithStartTimestamp asks the server, in the authentication of the first
+// connection, to position the client at the first change executed at or after
+// t. Reconnects resume from the acked cursor.
+//
+// There is no way to start at a binlog journal and position instead: the
+// ClientAuth packet only carries a timestamp, and canal servers reject the
+// DUMP packet that would carry a position. Starting at a position means
+// resetting the meta of the destination on the server.
+func WithStartTimestamp(t time.Time) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		o.startTimestamp = t
+	})
+}
+
+// WithLogger reports every protocol step to logger. Nothing is logged by
+// default, nor when logger is nil.
+func WithLogger(logger Logger) ClientOption {
+	return newFuncDialOption(func(o *clientOptions) {
+		if logger == nil {
+			logger = NopLogger()
+		}
+		o.logger = logger
+	})
+}
@@ -0,0 +1,254 @@
+package canal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/katakurin/canal/protobuf/protocol"
+)
+
+var (
+	ErrPrefetcherClosed = errors.New("prefetcher is closed")
+)
+
+// Prefetcher keeps several Get requests in flight on a Client so that
+// fetching the next batches overlaps with processing the current one. The
+// server answers requests of a connection in order, so batches come out in
+// the order they were fetched, and acks must follow that order: Ack queues a
+// batch acked early until every batch before it is acked too.
+//
+// A Prefetcher owns the connection until it is closed: it holds the lock
+// serializing exchanges on the Client, so every other call on the Client,
+// Disconnect included, waits for Close. Batches are acked with the Ack of
+// the Prefetcher.
+type Prefetcher struct {
+	c         *Client
+	depth     int
+	batchSize int
+	timeout   time.Duration
+
+	messages chan prefetched
+	taken    chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	err      error
+
+	ackMu sync.Mutex
+	// unacked holds the IDs of the fetched batches not acked yet, in order,
+	// and acked the ones among them Ack was already called for.
+	unacked []int64
+	acked   map[int64]bool
+	ackErr  error
+	closed  bool
+}
+
+type prefetched struct {
+	message *Message
+	err     error
+}
+
+// Prefetch starts keeping up to depth batches of batchSize entries fetched
+// ahead, either in flight or waiting for Next. Every request waits up to
+// timeout on the server, a second when it is not positive. The Client is
+// held until the Prefetcher is closed.
+func (c *Client) Prefetch(ctx context.Context, depth, batchSize int, timeout time.Duration) (*Prefetcher, error) {
+	if depth <= 0 {
+		depth = 1
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	c.lock(timeout)
+	if err := c.ensureConnected(ctx); err != nil {
+		c.unlock()
+		return nil, err
+	}
+	if !c.subscribed {
+		c.unlock()
+		return nil, ErrNotSubscribed
+	}
+
+	p := &Prefetcher{
+		c:         c,
+		depth:     depth,
+		batchSize: batchSize,
+		timeout:   timeout,
+		// One more slot for the error ending the prefetching.
+		messages: make(chan prefetched, depth+1),
+		taken:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		acked:    make(map[int64]bool),
+	}
+	go p.run()
+	return p, nil
+}
+
+// run issues Get requests while fewer than depth batches are in flight or
+// buffered, and reads their answers.
+func (p *Prefetcher) run() {
+	defer close(p.done)
+	c := p.c
+	inflight := 0
+	stopping := false
+
+	for {
+		if !stopping {
+			select {
+			case <-p.stop:
+				stopping = true
+			default:
+			}
+		}
+		for !stopping && inflight+len(p.messages) < p.depth {
+			if err := c.writePacket(c.getPacket(p.batchSize, p.timeout)); err != nil {
+				p.fail(err)
+				return
+			}
+			inflight++
+		}
+
+		if inflight == 0 {
+			if stopping {
+				return
+			}
+			// The buffer is full, wait for Next to make room.
+			select {
+			case <-p.stop:
+				stopping = true
+			case <-p.taken:
+			}
+			continue
+		}
+
+		if c.hb != nil {
+			c.hb.enter(p.timeout)
+		}
+		packet := &protocol.Packet{}
+		err := c.readPacketWait(packet, p.timeout)
+		if c.hb != nil {
+			// Waiting for Next to make room is not an exchange.
+			c.hb.leave()
+		}
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		inflight--
+		message, err := c.parseMessage(packet)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		if message.ID == -1 || stopping {
+			// Batches fetched while stopping are rolled back by Close.
+			continue
+		}
+
+		p.ackMu.Lock()
+		p.unacked = append(p.unacked, message.ID)
+		p.ackMu.Unlock()
+		p.messages <- prefetched{message: message}
+	}
+}
+
+func (p *Prefetcher) fail(err error) {
+	p.err = err
+	p.messages <- prefetched{err: err}
+}
+
+// Next returns the next fetched batch, waiting for it if needed. Empty
+// batches are skipped.
+func (p *Prefetcher) Next(ctx context.Context) (*Message, error) {
+	p.ackMu.Lock()
+	closed := p.closed
+	p.ackMu.Unlock()
+	if closed {
+		return nil, ErrPrefetcherClosed
+	}
+
+	select {
+	case m := <-p.messages:
+		if m.err != nil {
+			// Keep reporting the error to later calls.
+			p.messages <- m
+			return nil, m.err
+		}
+		select {
+		case p.taken <- struct{}{}:
+		default:
+		}
+		return m.message, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ack acknowledges batchID once every batch fetched before it is
+// acknowledged. Acks are fire-and-forget, they are sent from the calling
+// goroutine while the Prefetcher keeps reading.
+func (p *Prefetcher) Ack(batchID int64) error {
+	p.ackMu.Lock()
+	defer p.ackMu.Unlock()
+	if p.closed {
+		return ErrPrefetcherClosed
+	}
+	if p.ackErr != nil {
+		return p.ackErr
+	}
+
+	known := false
+	for _, id := range p.unacked {
+		if id == batchID {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("%w: batch %d was not fetched or is already acked", ErrInvalidBatch, batchID)
+	}
+	p.acked[batchID] = true
+
+	for len(p.unacked) > 0 && p.acked[p.unacked[0]] {
+		id := p.unacked[0]
+		if err := p.c.send(p.c.ackPacket(id)); err != nil {
+			p.ackErr = err
+			return err
+		}
+		delete(p.acked, id)
+		p.unacked = p.unacked[1:]
+	}
+	return nil
+}
+
+// Close stops fetching, waits for the requests in flight to be answered and
+// rolls back every batch not acked yet, including those still buffered or
+// waiting for earlier batches to be acked. The Client can then be used again.
+func (p *Prefetcher) Close() error {
+	p.ackMu.Lock()
+	if p.closed {
+		p.ackMu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.ackMu.Unlock()
+
+	close(p.stop)
+	<-p.done
+	c := p.c
+	defer c.unlock()
+
+	if p.err != nil || p.ackErr != nil {
+		c.markBroken()
+		if p.err != nil {
+			return p.err
+		}
+		return p.ackErr
+	}
+	// Batches fetched while stopping are not tracked, roll back regardless.
+	return c.rollback(0)
+}
@@ -0,0 +1,302 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var (
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+	ErrCorruptLZF             = errors.New("corrupt lzf data")
+)
+
+// IsCompressed tells whether c actually transforms the body.
+func (c Compression) IsCompressed() bool {
+	return c != Compression_NONE && c != Compression_COMPRESSIONCOMPATIBLEPROTO2
+}
+
+// DecompressBody returns the body of p decoded according to its Compression,
+// of at most DefaultMaxFrameSize bytes.
+func (p *Packet) DecompressBody() ([]byte, error) {
+	return p.DecompressBodyLimit(DefaultMaxFrameSize)
+}
+
+// DecompressBodyLimit is like DecompressBody but fails with ErrFrameTooLarge
+// once the body expands beyond max bytes.
+func (p *Packet) DecompressBodyLimit(max int) ([]byte, error) {
+	return DecompressLimit(p.GetCompression(), p.GetBody(), max)
+}
+
+// CompressBody encodes the body of p with c and records c on the packet.
+func (p *Packet) CompressBody(c Compression) error {
+	body, err := Compress(c, p.GetBody())
+	if err != nil {
+		return err
+	}
+	p.Body = body
+	p.CompressionPresent = &Packet_Compression{Compression: c}
+	return nil
+}
+
+// Decompress decodes data compressed with c, failing with ErrFrameTooLarge
+// when it expands beyond DefaultMaxFrameSize bytes.
+func Decompress(c Compression, data []byte) ([]byte, error) {
+	return DecompressLimit(c, data, DefaultMaxFrameSize)
+}
+
+// DecompressLimit decodes data compressed with c, failing with
+// ErrFrameTooLarge once it expands beyond max bytes, so that a small frame
+// cannot inflate without bound. A max of zero or less means no limit.
+func DecompressLimit(c Compression, data []byte, max int) ([]byte, error) {
+	switch c {
+	case Compression_NONE, Compression_COMPRESSIONCOMPATIBLEPROTO2:
+		return data, nil
+	case Compression_ZLIB:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readAllLimit(r, max)
+	case Compression_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readAllLimit(r, max)
+	case Compression_LZF:
+		return decompressLZF(data, max)
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCompression, c)
+	}
+}
+
+func readAllLimit(r io.Reader, max int) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > max {
+		return nil, errDecompressedTooLarge(max)
+	}
+	return out, nil
+}
+
+func errDecompressedTooLarge(max int) error {
+	return fmt.Errorf("%w: decompressed body exceeds %d bytes", ErrFrameTooLarge, max)
+}
+
+func Compress(c Compression, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c {
+	case Compression_NONE, Compression_COMPRESSIONCOMPATIBLEPROTO2:
+		return data, nil
+	case Compression_ZLIB:
+		w = zlib.NewWriter(&buf)
+	case Compression_GZIP:
+		w = gzip.NewWriter(&buf)
+	case Compression_LZF:
+		return compressLZF(data), nil
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedCompression, c)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LZF data uses the chunked format of the Java compress-lzf library: every
+// chunk starts with "ZV", a type byte and the big endian stored length,
+// followed for compressed chunks by the original length.
+const (
+	lzfChunkMax        = 0xffff
+	lzfChunkUncompress = 0
+	lzfChunkCompressed = 1
+)
+
+func decompressLZF(data []byte, max int) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		if len(data) < 5 || data[0] != 'Z' || data[1] != 'V' {
+			return nil, ErrCorruptLZF
+		}
+		typ := data[2]
+		stored := int(binary.BigEndian.Uint16(data[3:5]))
+		switch typ {
+		case lzfChunkUncompress:
+			data = data[5:]
+			if len(data) < stored {
+				return nil, ErrCorruptLZF
+			}
+			if max > 0 && len(out)+stored > max {
+				return nil, errDecompressedTooLarge(max)
+			}
+			out = append(out, data[:stored]...)
+			data = data[stored:]
+		case lzfChunkCompressed:
+			if len(data) < 7 {
+				return nil, ErrCorruptLZF
+			}
+			original := int(binary.BigEndian.Uint16(data[5:7]))
+			data = data[7:]
+			if len(data) < stored {
+				return nil, ErrCorruptLZF
+			}
+			if max > 0 && len(out)+original > max {
+				return nil, errDecompressedTooLarge(max)
+			}
+			var err error
+			if out, err = lzfDecodeBlock(out, data[:stored], original); err != nil {
+				return nil, err
+			}
+			data = data[stored:]
+		default:
+			return nil, ErrCorruptLZF
+		}
+	}
+	return out, nil
+}
+
+// lzfDecodeBlock appends the decoded form of one raw LZF block to out.
+func lzfDecodeBlock(out, in []byte, original int) ([]byte, error) {
+	start := len(out)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 {
+			n := ctrl + 1
+			if ip+n > len(in) {
+				return nil, ErrCorruptLZF
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, ErrCorruptLZF
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, ErrCorruptLZF
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[ip]) - 1
+		ip++
+		if ref < start {
+			return nil, ErrCorruptLZF
+		}
+		for i := 0; i < n+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out)-start != original {
+		return nil, ErrCorruptLZF
+	}
+	return out, nil
+}
+
+func compressLZF(data []byte) []byte {
+	out := make([]byte, 0, len(data)/2+16)
+	for len(data) > 0 {
+		n := len(data)
+		if n > lzfChunkMax {
+			n = lzfChunkMax
+		}
+		chunk := data[:n]
+		data = data[n:]
+
+		block := lzfEncodeBlock(chunk)
+		if len(block) < len(chunk) {
+			out = append(out, 'Z', 'V', lzfChunkCompressed, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(out[len(out)-4:], uint16(len(block)))
+			binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(chunk)))
+			out = append(out, block...)
+		} else {
+			out = append(out, 'Z', 'V', lzfChunkUncompress, 0, 0)
+			binary.BigEndian.PutUint16(out[len(out)-2:], uint16(len(chunk)))
+			out = append(out, chunk...)
+		}
+	}
+	return out
+}
+
+const (
+	lzfHashBits   = 14
+	lzfMaxLiteral = 1 << 5
+	lzfMaxOffset  = 1 << 13
+	lzfMaxRef     = (1 << 8) + (1 << 3)
+)
+
+// lzfEncodeBlock is a greedy LZF encoder looking up three byte sequences in a
+// hash table of their last position.
+func lzfEncodeBlock(in []byte) []byte {
+	var table [1 << lzfHashBits]int
+	out := make([]byte, 0, len(in))
+	literal := 0
+	// litPos is the index in out of the control byte of the pending literal run.
+	litPos := -1
+
+	emitLiteral := func(b byte) {
+		if literal == 0 {
+			litPos = len(out)
+			out = append(out, 0)
+		}
+		out = append(out, b)
+		literal++
+		out[litPos] = byte(literal - 1)
+		if literal == lzfMaxLiteral {
+			literal = 0
+		}
+	}
+
+	ip := 0
+	for ip+2 < len(in) {
+		h := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - lzfHashBits)
+		ref := table[h] - 1
+		table[h] = ip + 1
+
+		off := ip - ref - 1
+		if ref < 0 || off >= lzfMaxOffset || in[ref] != in[ip] || in[ref+1] != in[ip+1] || in[ref+2] != in[ip+2] {
+			emitLiteral(in[ip])
+			ip++
+			continue
+		}
+
+		n := 3
+		for n < lzfMaxRef && ip+n < len(in) && in[ref+n] == in[ip+n] {
+			n++
+		}
+		literal = 0
+		l := n - 2
+		if l < 7 {
+			out = append(out, byte(l<<5|off>>8))
+		} else {
+			out = append(out, byte(7<<5|off>>8), byte(l-7))
+		}
+		out = append(out, byte(off))
+		ip += n
+	}
+	for ; ip < len(in); ip++ {
+		emitLiteral(in[ip])
+	}
+	return out
+}
@@ -2,42 +2,87 @@ package protocol
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
 
 	"google.golang.org/protobuf/proto"
 )
 
-func (p *Packet) Read(reader io.Reader) (err error) {
-	headBuf := make([]byte, 4)
-	_, err = io.ReadFull(reader, headBuf)
-	if err != nil {
-		return
+// DefaultMaxFrameSize bounds the frames Read accepts, and the bodies
+// Decompress inflates. The length header of anything but a canal stream, such
+// as an HTTP response, decodes to a huge size and is rejected instead of
+// allocated.
+const DefaultMaxFrameSize = 256 << 20
+
+var ErrFrameTooLarge = errors.New("canal frame exceeds the maximum size")
+
+// maxPooledBuffer keeps the odd huge batch from pinning memory in the pool.
+const maxPooledBuffer = 4 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4<<10)
+		return &b
+	},
+}
+
+func getBuffer(n int) *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, n)
 	}
-	bodyLen := int(binary.BigEndian.Uint32(headBuf))
-	body := make([]byte, bodyLen)
-	_, err = io.ReadFull(reader, body)
-	if err != nil {
+	*b = (*b)[:n]
+	return b
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
 		return
 	}
-	err = proto.Unmarshal(body, p)
-	if err != nil {
+	bufferPool.Put(b)
+}
+
+// Read reads a frame of at most DefaultMaxFrameSize bytes into p.
+func (p *Packet) Read(reader io.Reader) error {
+	return p.ReadLimit(reader, DefaultMaxFrameSize)
+}
+
+// ReadLimit reads a frame into p, failing with ErrFrameTooLarge when its
+// length header exceeds max bytes. A max of zero or less means no limit. The
+// limit covers the wire bytes only: decompress the body of p with
+// DecompressBodyLimit to bound its decoded size as well.
+func (p *Packet) ReadLimit(reader io.Reader, max int) error {
+	buf := getBuffer(4)
+	defer putBuffer(buf)
+	if _, err := io.ReadFull(reader, *buf); err != nil {
 		return err
 	}
-	return
-}
+	bodyLen := int64(binary.BigEndian.Uint32(*buf))
+	if max > 0 && bodyLen > int64(max) {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrFrameTooLarge, bodyLen, max)
+	}
 
-func (p *Packet) Write(writer io.Writer) (err error) {
-	var body []byte
-	body, err = proto.Marshal(p)
-	if err != nil {
-		return
+	// The body can go back to the pool: Unmarshal copies the bytes it keeps.
+	body := getBuffer(int(bodyLen))
+	defer putBuffer(body)
+	if _, err := io.ReadFull(reader, *body); err != nil {
+		return err
 	}
-	headBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(headBuf, uint32(len(body)))
-	_, err = writer.Write(headBuf)
+	return proto.Unmarshal(*body, p)
+}
+
+// Write writes p as one frame, with a single call to writer.
+func (p *Packet) Write(writer io.Writer) error {
+	buf := getBuffer(4)
+	defer putBuffer(buf)
+	frame, err := proto.MarshalOptions{}.MarshalAppend(*buf, p)
 	if err != nil {
-		return
+		return err
 	}
-	_, err = writer.Write(body)
-	return
+	*buf = frame
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	_, err = writer.Write(frame)
+	return err
 }
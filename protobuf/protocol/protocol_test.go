@@ -0,0 +1,185 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func benchmarkPacket(size int) *Packet {
+	messages := &Messages{BatchId: 1}
+	for n := 0; n < size; n += 512 {
+		messages.Messages = append(messages.Messages, bytes.Repeat([]byte{'x'}, 512))
+	}
+	body, _ := proto.Marshal(messages)
+	return &Packet{Type: PacketType_MESSAGES, Body: body}
+}
+
+func BenchmarkPacketWrite(b *testing.B) {
+	p := benchmarkPacket(64 << 10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := p.Write(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPacketRead(b *testing.B) {
+	var buf bytes.Buffer
+	if err := benchmarkPacket(64 << 10).Write(&buf); err != nil {
+		b.Fatal(err)
+	}
+	frame := buf.Bytes()
+	r := bytes.NewReader(frame)
+	p := &Packet{}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(frame)
+		if err := p.Read(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	want := benchmarkPacket(8 << 10)
+	var buf bytes.Buffer
+	if err := want.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := &Packet{}
+	if err := got.Read(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Fatal("packet changed in a write/read round trip")
+	}
+}
+
+func TestPacketReadLimit(t *testing.T) {
+	// "HTTP" read as a length header.
+	r := bytes.NewReader([]byte("HTTP/1.1 400 Bad Request\r\n"))
+	err := (&Packet{}).ReadLimit(r, 1<<20)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("err = %v, want ErrFrameTooLarge", err)
+	}
+}
+
+// The LZF blocks below are the output of the reference liblzf encoder,
+// framed in the chunks of compress-lzf.
+var (
+	// 50 times 'a': a literal, then a long back-reference to the previous
+	// byte overlapping itself.
+	lzfRepeated = []byte{0x01, 0x61, 0x61, 0xe0, 0x25, 0x00, 0x01, 0x61, 0x61}
+	lzfSentence = []byte{
+		0x06, 0x63, 0x61, 0x6e, 0x61, 0x6c, 0x20, 0x63, 0xe0, 0x01, 0x05, 0x0e,
+		0x2c, 0x20, 0x74, 0x68, 0x65, 0x20, 0x62, 0x69, 0x6e, 0x6c, 0x6f, 0x67,
+		0x20, 0x6f, 0x66, 0xa0, 0x1a, 0x01, 0x69, 0x73, 0xe0, 0x06, 0x16, 0x04,
+		0x6d, 0x79, 0x73, 0x71, 0x6c,
+	}
+	sentence = "canal canal canal, the binlog of canal is the binlog of mysql"
+)
+
+func lzfChunk(typ byte, original int, block []byte) []byte {
+	chunk := []byte{'Z', 'V', typ, byte(len(block) >> 8), byte(len(block))}
+	if typ == lzfChunkCompressed {
+		chunk = append(chunk, byte(original>>8), byte(original))
+	}
+	return append(chunk, block...)
+}
+
+func TestDecompressLZF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"uncompressed", lzfChunk(lzfChunkUncompress, 0, []byte("short")), "short"},
+		{"compressed", lzfChunk(lzfChunkCompressed, 50, lzfRepeated), string(bytes.Repeat([]byte{'a'}, 50))},
+		{"short back-references", lzfChunk(lzfChunkCompressed, len(sentence), lzfSentence), sentence},
+		{"chunks", append(lzfChunk(lzfChunkCompressed, len(sentence), lzfSentence),
+			lzfChunk(lzfChunkUncompress, 0, []byte("!"))...), sentence + "!"},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := Decompress(Compression_LZF, tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	corrupt := map[string][]byte{
+		"magic":           append([]byte("ZX"), lzfChunk(lzfChunkUncompress, 0, []byte("short"))[2:]...),
+		"chunk type":      lzfChunk(2, 0, []byte("short")),
+		"truncated chunk": lzfChunk(lzfChunkUncompress, 0, []byte("short"))[:8],
+		"truncated block": lzfChunk(lzfChunkCompressed, 50, lzfRepeated[:4]),
+		"original length": lzfChunk(lzfChunkCompressed, 49, lzfRepeated),
+		"reference":       lzfChunk(lzfChunkCompressed, 3, []byte{0x20, 0x05}),
+	}
+	for name, data := range corrupt {
+		if _, err := Decompress(Compression_LZF, data); !errors.Is(err, ErrCorruptLZF) {
+			t.Errorf("%s: err = %v, want ErrCorruptLZF", name, err)
+		}
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	// Over 64KiB, so that LZF needs several chunks.
+	data := bytes.Repeat([]byte(sentence), 2000)
+	for _, c := range []Compression{Compression_NONE, Compression_ZLIB, Compression_GZIP, Compression_LZF} {
+		compressed, err := Compress(c, data)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		if c.IsCompressed() && len(compressed) >= len(data) {
+			t.Errorf("%v: compressed %d bytes into %d", c, len(data), len(compressed))
+		}
+		got, err := Decompress(c, compressed)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%v: data changed in a round trip", c)
+		}
+	}
+
+	p := &Packet{Type: PacketType_MESSAGES, Body: []byte(sentence)}
+	if err := p.CompressBody(Compression_GZIP); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := p.DecompressBody(); err != nil || string(body) != sentence {
+		t.Fatalf("body = %q, %v", body, err)
+	}
+	if _, err := Decompress(Compression(42), nil); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatalf("err = %v, want ErrUnsupportedCompression", err)
+	}
+}
+
+func TestDecompressBomb(t *testing.T) {
+	const max = 1 << 20
+	data := make([]byte, 8*max)
+	for _, c := range []Compression{Compression_ZLIB, Compression_GZIP, Compression_LZF} {
+		bomb, err := Compress(c, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bomb) > max/4 {
+			t.Fatalf("%v: the bomb is %d bytes", c, len(bomb))
+		}
+		if _, err := DecompressLimit(c, bomb, max); !errors.Is(err, ErrFrameTooLarge) {
+			t.Errorf("%v: err = %v, want ErrFrameTooLarge", c, err)
+		}
+		if got, err := DecompressLimit(c, bomb, len(data)); err != nil || len(got) != len(data) {
+			t.Errorf("%v: got %d bytes, %v at the exact limit", c, len(got), err)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Package proxy shares a single upstream canal destination between several
+// downstream canal clients. Each downstream clientId gets its own ack cursor
+// and filter, while the upstream batches are only acked once every downstream
+// client acknowledged them.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/protobuf/entry"
+	"github.com/katakurin/canal/server"
+)
+
+type proxyOptions struct {
+	destination   string
+	maxBuffered   int64
+	retryInterval time.Duration
+	logger        canal.Logger
+	serverOptions []server.Option
+}
+
+func defaultProxyOptions() proxyOptions {
+	return proxyOptions{
+		retryInterval: 5 * time.Second,
+		logger:        canal.NopLogger(),
+	}
+}
+
+// Option configures a Proxy.
+type Option interface {
+	apply(*proxyOptions)
+}
+
+type funcOption struct {
+	f func(*proxyOptions)
+}
+
+func (fo *funcOption) apply(o *proxyOptions) {
+	fo.f(o)
+}
+
+func newFuncOption(f func(*proxyOptions)) *funcOption {
+	return &funcOption{
+		f: f,
+	}
+}
+
+// WithDestination sets the destination name downstream clients connect to.
+// It defaults to the upstream destination.
+func WithDestination(destination string) Option {
+	return newFuncOption(func(o *proxyOptions) {
+		o.destination = destination
+	})
+}
+
+// WithMaxBuffered pauses fetching from upstream while n entries wait for the
+// slowest downstream client. Zero, the default, never pauses.
+func WithMaxBuffered(n int) Option {
+	return newFuncOption(func(o *proxyOptions) {
+		o.maxBuffered = int64(n)
+	})
+}
+
+// WithRetryInterval sets how long the proxy waits before reconnecting to
+// upstream after an error.
+func WithRetryInterval(d time.Duration) Option {
+	return newFuncOption(func(o *proxyOptions) {
+		o.retryInterval = d
+	})
+}
+
+// WithLogger reports upstream failures and downstream connections to
+// logger. Nothing is logged by default, nor when logger is nil.
+func WithLogger(logger canal.Logger) Option {
+	return newFuncOption(func(o *proxyOptions) {
+		if logger == nil {
+			logger = canal.NopLogger()
+		}
+		o.logger = logger
+	})
+}
+
+// WithServerOptions configures the server downstream clients connect to.
+func WithServerOptions(opts ...server.Option) Option {
+	return newFuncOption(func(o *proxyOptions) {
+		o.serverOptions = append(o.serverOptions, opts...)
+	})
+}
+
+var (
+	// ErrUnknownConsumer rejects downstream clients whose clientId the proxy
+	// was not created with.
+	ErrUnknownConsumer = errors.New("clientId is not a consumer of the proxy")
+)
+
+// Proxy fetches batches from one upstream destination into a Store and serves
+// them to downstream clients. Only the clientIds it was created with may
+// consume: an upstream batch is acked once all of them acked past its last
+// entry, so a consumer that never shows up holds everything back.
+//
+// The upstream connection is consumed in the Run goroutine, downstream
+// clients are served with Serve or ListenAndServe.
+type Proxy struct {
+	upstream  *canal.Config
+	consumers map[string]struct{}
+	store     Store
+	opts      proxyOptions
+	srv       *server.Server
+
+	mu    sync.Mutex
+	state State
+	// pending holds the upstream batches not acked yet, oldest first.
+	pending []pendingBatch
+	// notify is closed and replaced whenever entries are appended.
+	notify chan struct{}
+	// commits wakes up Run when a downstream client acked.
+	commits chan struct{}
+}
+
+type pendingBatch struct {
+	id int64
+	// end is the offset right after the last entry of the batch.
+	end int64
+}
+
+// New creates a proxy consuming upstream on behalf of the downstream
+// clientIds consumers. Consumers seen for the first time start at the oldest
+// entry of store.
+func New(upstream *canal.Config, consumers []string, store Store, opts ...Option) (*Proxy, error) {
+	if err := upstream.Validate(); err != nil {
+		return nil, err
+	}
+	if len(consumers) == 0 {
+		return nil, errors.New("proxy needs at least one consumer")
+	}
+	// The store needs parsed entries whatever the config says.
+	cfg := *upstream
+	cfg.LazyParseEntry = false
+	p := &Proxy{
+		upstream:  &cfg,
+		consumers: make(map[string]struct{}, len(consumers)),
+		store:     store,
+		opts:      defaultProxyOptions(),
+		notify:    make(chan struct{}),
+		commits:   make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt.apply(&p.opts)
+	}
+	if p.opts.destination == "" {
+		p.opts.destination = upstream.Destination
+	}
+
+	state, err := store.State()
+	if err != nil {
+		return nil, err
+	}
+	first, _ := store.Bounds()
+	for _, id := range consumers {
+		p.consumers[id] = struct{}{}
+		if _, ok := state.Cursors[id]; !ok {
+			state.Cursors[id] = first
+		}
+	}
+	p.state = state
+	p.srv = server.New(p, append([]server.Option{server.WithLogger(p.opts.logger)}, p.opts.serverOptions...)...)
+	return p, nil
+}
+
+// Serve serves downstream clients on l until the proxy is closed.
+func (p *Proxy) Serve(l net.Listener) error {
+	return p.srv.Serve(l)
+}
+
+// ListenAndServe serves downstream clients on the TCP address addr until the
+// proxy is closed.
+func (p *Proxy) ListenAndServe(addr string) error {
+	return p.srv.ListenAndServe(addr)
+}
+
+// Close disconnects every downstream client. It does not stop Run, cancel
+// its context for that.
+func (p *Proxy) Close() error {
+	return p.srv.Close()
+}
+
+// Run consumes the upstream destination until ctx is done, reconnecting
+// after errors. It only gives up early when upstream rejects the
+// credentials or the destination.
+func (p *Proxy) Run(ctx context.Context) error {
+	log := p.opts.logger
+	for {
+		err := p.consume(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, canal.ErrAuthFailed) || errors.Is(err, canal.ErrDestinationNotFound) {
+			return err
+		}
+		log.Warn("upstream canal connection failed", canal.F("addr", p.upstream.Addr),
+			canal.F("destination", p.upstream.Destination), canal.F("error", err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.opts.retryInterval):
+		}
+	}
+}
+
+// consume runs one upstream connection. Batch IDs only make sense on the
+// connection they were fetched on, so every unacked batch is rolled back
+// when connecting and fetched again; the entries already in the store are
+// recognized by counting from the last upstream ack.
+func (p *Proxy) consume(ctx context.Context) error {
+	client, err := canal.NewClientFromConfig(p.upstream, canal.WithLogger(p.opts.logger))
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect()
+	if err := client.RollbackContext(ctx, 0); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.pending = nil
+	replay := p.state.UpstreamAcked
+	p.mu.Unlock()
+
+	timeout := p.upstream.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	for {
+		if err := p.ackUpstream(ctx, client); err != nil {
+			return err
+		}
+		if p.full() {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-p.commits:
+			}
+			continue
+		}
+
+		message, err := client.GetWithOutAckContext(ctx, p.upstream.BatchSize, timeout)
+		if err != nil {
+			return err
+		}
+		if message.ID == -1 {
+			continue
+		}
+
+		entries := message.Entries
+		_, end := p.store.Bounds()
+		if skip := end - replay; skip < int64(len(entries)) {
+			if skip > 0 {
+				entries = entries[skip:]
+			}
+			if err := p.store.Append(entries); err != nil {
+				return err
+			}
+		}
+		replay += int64(len(message.Entries))
+
+		p.mu.Lock()
+		p.pending = append(p.pending, pendingBatch{id: message.ID, end: replay})
+		close(p.notify)
+		p.notify = make(chan struct{})
+		p.mu.Unlock()
+	}
+}
+
+// ackUpstream acks the upstream batches every consumer is done with and
+// drops their entries from the store. The new UpstreamAcked is saved before
+// acking: upstream acks are fire-and-forget, and a batch acked but not
+// recorded would shift the replay after a restart and lose entries, while a
+// batch recorded but not acked is only fetched and served again.
+func (p *Proxy) ackUpstream(ctx context.Context, client *canal.Client) error {
+	p.mu.Lock()
+	low := p.lowCursor()
+	n := 0
+	for n < len(p.pending) && p.pending[n].end <= low {
+		n++
+	}
+	if n == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	state := copyState(p.state)
+	state.UpstreamAcked = p.pending[n-1].end
+	if err := p.store.SaveState(state); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	p.state.UpstreamAcked = state.UpstreamAcked
+	acked := p.pending[:n]
+	p.pending = p.pending[n:]
+	p.mu.Unlock()
+
+	for _, batch := range acked {
+		if err := client.AckContext(ctx, batch.id); err != nil {
+			return err
+		}
+	}
+	return p.store.Truncate(low)
+}
+
+// full reports whether the slowest consumer is too far behind to fetch more.
+func (p *Proxy) full() bool {
+	if p.opts.maxBuffered <= 0 {
+		return false
+	}
+	_, end := p.store.Bounds()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return end-p.lowCursor() >= p.opts.maxBuffered
+}
+
+// lowCursor returns the cursor of the slowest consumer. p.mu must be held.
+func (p *Proxy) lowCursor() int64 {
+	low := int64(-1)
+	for id := range p.consumers {
+		if c := p.state.Cursors[id]; low < 0 || c < low {
+			low = c
+		}
+	}
+	return low
+}
+
+// Fetch implements server.EntrySource.
+func (p *Proxy) Fetch(ctx context.Context, destination string, cursor server.Cursor, max int) ([]*entry.Entry, server.Cursor, error) {
+	if destination != p.opts.destination {
+		return nil, cursor, server.ErrUnknownDestination
+	}
+	offset, err := strconv.ParseInt(string(cursor), 10, 64)
+	if err != nil {
+		return nil, cursor, fmt.Errorf("invalid proxy cursor %q", cursor)
+	}
+
+	for {
+		p.mu.Lock()
+		notify := p.notify
+		p.mu.Unlock()
+
+		entries, err := p.store.Read(offset, max)
+		if err != nil {
+			return nil, cursor, err
+		}
+		if len(entries) > 0 {
+			return entries, server.Cursor(strconv.FormatInt(offset+int64(len(entries)), 10)), nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, cursor, nil
+		case <-notify:
+		}
+	}
+}
+
+// Commit implements server.EntrySource.
+func (p *Proxy) Commit(destination, clientID string, cursor server.Cursor) error {
+	offset, err := strconv.ParseInt(string(cursor), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid proxy cursor %q", cursor)
+	}
+
+	p.mu.Lock()
+	p.state.Cursors[clientID] = offset
+	err = p.store.SaveState(p.state)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.commits <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Cursor implements server.EntrySource.
+func (p *Proxy) Cursor(destination, clientID string) (server.Cursor, error) {
+	if destination != p.opts.destination {
+		return "", server.ErrUnknownDestination
+	}
+	if _, ok := p.consumers[clientID]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownConsumer, clientID)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return server.Cursor(strconv.FormatInt(p.state.Cursors[clientID], 10)), nil
+}
@@ -0,0 +1,314 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/canaltest"
+	"github.com/katakurin/canal/protobuf/entry"
+	"github.com/katakurin/canal/proxy"
+)
+
+// startProxy runs a proxy of the example destination of upstream, serving on
+// a random port. stop ends it, like a killed process.
+func startProxy(t *testing.T, upstream string, store proxy.Store, consumers []string, opts ...proxy.Option) (addr string, stop func()) {
+	t.Helper()
+	cfg, err := canal.ParseDSN("canal://" + upstream + "/example?timeout=50ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]proxy.Option{proxy.WithRetryInterval(10 * time.Millisecond)}, opts...)
+	p, err := proxy.New(cfg, consumers, store, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			p.Close()
+		})
+	}
+	t.Cleanup(stop)
+	return l.Addr().String(), stop
+}
+
+func connect(t *testing.T, addr string, clientID int) *canal.Client {
+	t.Helper()
+	client, err := canal.NewClient(addr, "example", canal.WithClientID(clientID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+	if err := client.Subscribe(""); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// consume gets and acks n entries, in batches of up to size, and returns
+// their table names.
+func consume(t *testing.T, client *canal.Client, n, size int) []string {
+	t.Helper()
+	var tables []string
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tables) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v, want %d entries", tables, n)
+		}
+		message, err := client.Get(size, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range message.Entries {
+			tables = append(tables, e.GetHeader().GetTableName())
+		}
+	}
+	return tables
+}
+
+func row(table string) *entry.Entry {
+	return canaltest.RowEntry("db", table, entry.EventType_INSERT)
+}
+
+// eventually waits for cond to hold.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal(what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var errCrash = errors.New("crash")
+
+// crashStore fails the first save of a new UpstreamAcked, like a proxy killed
+// right before saving it.
+type crashStore struct {
+	proxy.Store
+	once    sync.Once
+	crashed chan struct{}
+}
+
+func (s *crashStore) SaveState(state proxy.State) error {
+	saved, err := s.Store.State()
+	if err != nil {
+		return err
+	}
+	if state.UpstreamAcked > saved.UpstreamAcked {
+		s.once.Do(func() { close(s.crashed) })
+		return errCrash
+	}
+	return s.Store.SaveState(state)
+}
+
+func TestProxyAcksUpstreamAfterSavingState(t *testing.T) {
+	upstream := canaltest.NewServer()
+	defer upstream.Close()
+	upstream.Enqueue("example", row("a1"), row("a2"))
+
+	store := proxy.NewMemoryStore()
+	crash := &crashStore{Store: store, crashed: make(chan struct{})}
+	addr, stop := startProxy(t, upstream.Addr(), crash, []string{"1001"})
+	client := connect(t, addr, 1001)
+	if got := consume(t, client, 2, 2); fmt.Sprint(got) != "[a1 a2]" {
+		t.Fatalf("got %v, want [a1 a2]", got)
+	}
+	<-crash.crashed
+	stop()
+	client.Disconnect()
+
+	// Restarted from the same store, the proxy must still serve what comes
+	// after the batch it could not record as acked.
+	upstream.Enqueue("example", row("b1"))
+	addr, _ = startProxy(t, upstream.Addr(), store, []string{"1001"})
+	client = connect(t, addr, 1001)
+	if got := consume(t, client, 1, 10); fmt.Sprint(got) != "[b1]" {
+		t.Fatalf("got %v after restarting, want [b1]", got)
+	}
+}
+
+func TestProxyReplayAfterReconnect(t *testing.T) {
+	upstream := canaltest.NewServer()
+	defer upstream.Close()
+	for _, table := range []string{"t1", "t2", "t3"} {
+		upstream.Enqueue("example", row(table))
+	}
+
+	addr, _ := startProxy(t, upstream.Addr(), proxy.NewMemoryStore(), []string{"1001"})
+	client := connect(t, addr, 1001)
+	got := consume(t, client, 1, 1)
+
+	// The upstream batches not acked yet are fetched again on the new
+	// connection, but served once.
+	upstream.DropConnections()
+	upstream.Enqueue("example", row("t4"))
+	got = append(got, consume(t, client, 3, 10)...)
+	if fmt.Sprint(got) != "[t1 t2 t3 t4]" {
+		t.Fatalf("got %v, want [t1 t2 t3 t4]", got)
+	}
+	if _, err := client.GetWithOutAck(10, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.Accepted() < 2 {
+		t.Fatal("the proxy did not reconnect")
+	}
+}
+
+func TestProxyFanOut(t *testing.T) {
+	upstream := canaltest.NewServer()
+	defer upstream.Close()
+	upstream.Enqueue("example", row("t1"), row("t2"))
+
+	addr, _ := startProxy(t, upstream.Addr(), proxy.NewMemoryStore(), []string{"1001", "1002"})
+	first := connect(t, addr, 1001)
+	second := connect(t, addr, 1002)
+
+	if got := consume(t, first, 2, 10); fmt.Sprint(got) != "[t1 t2]" {
+		t.Fatalf("first consumer got %v", got)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if acked := upstream.Acked("example", "1001"); len(acked) != 0 {
+		t.Fatalf("upstream acked %v before the second consumer", acked)
+	}
+
+	if got := consume(t, second, 2, 10); fmt.Sprint(got) != "[t1 t2]" {
+		t.Fatalf("second consumer got %v", got)
+	}
+	eventually(t, "upstream batch not acked after both consumers", func() bool {
+		return len(upstream.Acked("example", "1001")) == 1
+	})
+}
+
+func TestProxyMaxBuffered(t *testing.T) {
+	upstream := canaltest.NewServer()
+	defer upstream.Close()
+	for i := 1; i <= 5; i++ {
+		upstream.Enqueue("example", row(fmt.Sprintf("t%d", i)))
+	}
+
+	store := proxy.NewMemoryStore()
+	addr, _ := startProxy(t, upstream.Addr(), store, []string{"1001"}, proxy.WithMaxBuffered(2))
+	eventually(t, "nothing fetched", func() bool {
+		_, end := store.Bounds()
+		return end == 2
+	})
+	time.Sleep(200 * time.Millisecond)
+	if _, end := store.Bounds(); end != 2 {
+		t.Fatalf("fetched %d entries, want the fetching paused at 2", end)
+	}
+
+	client := connect(t, addr, 1001)
+	if got := consume(t, client, 5, 10); fmt.Sprint(got) != "[t1 t2 t3 t4 t5]" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	segments := func() int {
+		names, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+		return len(names)
+	}
+	tables := func(entries []*entry.Entry) string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.GetHeader().GetTableName())
+		}
+		return fmt.Sprint(names)
+	}
+
+	// Every append past the tiny segment size starts a new segment.
+	store, err := proxy.OpenFileStore(dir, proxy.WithSegmentSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range [][]*entry.Entry{{row("e0"), row("e1")}, {row("e2"), row("e3")}, {row("e4")}} {
+		if err := store.Append(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := segments(); n != 3 {
+		t.Fatalf("%d segments, want 3", n)
+	}
+	if entries, err := store.Read(1, 10); err != nil || tables(entries) != "[e1]" {
+		t.Fatalf("Read(1) = %s, %v, want the rest of the first segment", tables(entries), err)
+	}
+
+	// Only whole segments are dropped.
+	if err := store.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if first, end := store.Bounds(); first != 2 || end != 5 || segments() != 2 {
+		t.Fatalf("bounds [%d, %d) in %d segments, want [2, 5) in 2", first, end, segments())
+	}
+	if _, err := store.Read(1, 10); !errors.Is(err, proxy.ErrTruncated) {
+		t.Fatalf("Read(1) = %v, want ErrTruncated", err)
+	}
+	state := proxy.State{UpstreamAcked: 3, Cursors: map[string]int64{"1001": 3}}
+	if err := store.SaveState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopened, with a record torn by a crash.
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("%020d.log", 4)), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42})
+	f.Close()
+	store, err = proxy.OpenFileStore(dir, proxy.WithSegmentSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if first, end := store.Bounds(); first != 2 || end != 5 {
+		t.Fatalf("reopened with bounds [%d, %d), want [2, 5)", first, end)
+	}
+	if entries, err := store.Read(2, 10); err != nil || tables(entries) != "[e2 e3]" {
+		t.Fatalf("Read(2) = %s, %v", tables(entries), err)
+	}
+	if got, err := store.State(); err != nil || got.UpstreamAcked != 3 || got.Cursors["1001"] != 3 {
+		t.Fatalf("State() = %+v, %v", got, err)
+	}
+
+	// Once everything is consumed a single empty segment is left.
+	if err := store.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if first, end := store.Bounds(); first != 5 || end != 5 || segments() != 1 {
+		t.Fatalf("bounds [%d, %d) in %d segments, want [5, 5) in 1", first, end, segments())
+	}
+	if err := store.Append([]*entry.Entry{row("e5")}); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := store.Read(5, 10); err != nil || tables(entries) != "[e5]" {
+		t.Fatalf("Read(5) = %s, %v", tables(entries), err)
+	}
+}
@@ -0,0 +1,460 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/katakurin/canal/protobuf/entry"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// State is the bookkeeping a Store persists next to the entries.
+type State struct {
+	// UpstreamAcked is the offset right after the last entry acked upstream.
+	UpstreamAcked int64 `json:"upstreamAcked"`
+	// Cursors holds the offset each downstream clientId acked up to.
+	Cursors map[string]int64 `json:"cursors"`
+}
+
+// Store keeps the entries fetched from upstream until every downstream
+// consumer acknowledged them. Offsets are positions in the stream of entries
+// since the store was created.
+type Store interface {
+	// Append stores entries after the last one.
+	Append(entries []*entry.Entry) error
+	// Read returns up to max entries starting at offset.
+	Read(offset int64, max int) ([]*entry.Entry, error)
+	// Bounds returns the offset of the first retained entry and the offset
+	// right after the last one.
+	Bounds() (first, end int64)
+	// Truncate drops the entries before offset. Stores may keep them longer.
+	Truncate(offset int64) error
+	State() (State, error)
+	SaveState(State) error
+	Close() error
+}
+
+// ErrTruncated is returned by Read for an offset before the first retained
+// entry.
+var ErrTruncated = errors.New("entries at this offset were already truncated")
+
+// MemoryStore is a Store that loses everything when the process exits.
+type MemoryStore struct {
+	mu      sync.Mutex
+	first   int64
+	entries []*entry.Entry
+	state   State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: State{Cursors: make(map[string]int64)}}
+}
+
+func (m *MemoryStore) Append(entries []*entry.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entries...)
+	return nil
+}
+
+func (m *MemoryStore) Read(offset int64, max int) ([]*entry.Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return readRange(m.entries, m.first, offset, max)
+}
+
+func (m *MemoryStore) Bounds() (int64, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.first, m.first + int64(len(m.entries))
+}
+
+func (m *MemoryStore) Truncate(offset int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n := offset - m.first; n > 0 {
+		if n > int64(len(m.entries)) {
+			n = int64(len(m.entries))
+		}
+		m.entries = append([]*entry.Entry(nil), m.entries[n:]...)
+		m.first += n
+	}
+	return nil
+}
+
+func (m *MemoryStore) State() (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return copyState(m.state), nil
+}
+
+func (m *MemoryStore) SaveState(state State) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = copyState(state)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore is a Store persisting entries in append-only segment files and
+// its state in a JSON file, all in one directory. Each segment is named after
+// the offset of its first entry; a new one is started once the current one
+// grows past the segment size, and Truncate deletes the segments whose
+// entries were all consumed.
+type FileStore struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	// segments are ordered by offset, the last one is appended to.
+	segments []*segment
+	state    State
+}
+
+// segment is one log file of a FileStore.
+type segment struct {
+	first int64
+	file  *os.File
+	// index holds the file position of every entry.
+	index []int64
+	size  int64
+}
+
+func (s *segment) end() int64 {
+	return s.first + int64(len(s.index))
+}
+
+type fileStoreOptions struct {
+	segmentSize int64
+}
+
+// FileStoreOption configures a FileStore.
+type FileStoreOption interface {
+	apply(*fileStoreOptions)
+}
+
+type funcFileStoreOption struct {
+	f func(*fileStoreOptions)
+}
+
+func (ffo *funcFileStoreOption) apply(o *fileStoreOptions) {
+	ffo.f(o)
+}
+
+func newFuncFileStoreOption(f func(*fileStoreOptions)) *funcFileStoreOption {
+	return &funcFileStoreOption{
+		f: f,
+	}
+}
+
+// WithSegmentSize sets the size in bytes past which a FileStore starts a new
+// segment file, 64 MiB by default. Disk space is reclaimed a segment at a
+// time.
+func WithSegmentSize(n int64) FileStoreOption {
+	return newFuncFileStoreOption(func(o *fileStoreOptions) {
+		o.segmentSize = n
+	})
+}
+
+const (
+	fileStoreState     = "state.json"
+	fileStoreSegment   = "%020d.log"
+	defaultSegmentSize = 64 << 20
+)
+
+// OpenFileStore opens or creates a FileStore in dir.
+func OpenFileStore(dir string, opts ...FileStoreOption) (*FileStore, error) {
+	o := fileStoreOptions{segmentSize: defaultSegmentSize}
+	for _, opt := range opts {
+		opt.apply(&o)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f := &FileStore{
+		dir:         dir,
+		segmentSize: o.segmentSize,
+		state:       State{Cursors: make(map[string]int64)},
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, fileStoreState))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &f.state); err != nil {
+			return nil, fmt.Errorf("read proxy state: %v", err)
+		}
+		if f.state.Cursors == nil {
+			f.state.Cursors = make(map[string]int64)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	if err := f.openSegments(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openSegments opens the segment files of the directory, or creates the
+// first one.
+func (f *FileStore) openSegments() error {
+	names, err := filepath.Glob(filepath.Join(f.dir, "*.log"))
+	if err != nil {
+		return err
+	}
+	var firsts []int64
+	for _, name := range names {
+		var first int64
+		if _, err := fmt.Sscanf(filepath.Base(name), fileStoreSegment, &first); err == nil {
+			firsts = append(firsts, first)
+		}
+	}
+	sort.Slice(firsts, func(i, j int) bool { return firsts[i] < firsts[j] })
+
+	for _, first := range firsts {
+		seg, err := f.openSegment(first)
+		if err != nil {
+			return err
+		}
+		f.segments = append(f.segments, seg)
+		if err := seg.scan(); err != nil {
+			return err
+		}
+	}
+	for i := 1; i < len(f.segments); i++ {
+		if prev := f.segments[i-1]; prev.end() != f.segments[i].first {
+			return fmt.Errorf("proxy segment %d ends at %d, the next one starts at %d",
+				prev.first, prev.end(), f.segments[i].first)
+		}
+	}
+	if len(f.segments) == 0 {
+		seg, err := f.openSegment(0)
+		if err != nil {
+			return err
+		}
+		f.segments = append(f.segments, seg)
+	}
+	return nil
+}
+
+func (f *FileStore) openSegment(first int64) (*segment, error) {
+	name := filepath.Join(f.dir, fmt.Sprintf(fileStoreSegment, first))
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{first: first, file: file}, nil
+}
+
+// scan rebuilds the index, dropping a record torn by a crash mid-append.
+func (s *segment) scan() error {
+	r := bufio.NewReader(io.NewSectionReader(s.file, 0, 1<<62))
+	var pos int64
+	var head [4]byte
+	for {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(head[:]))
+		if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+			break
+		}
+		s.index = append(s.index, pos)
+		pos += 4 + n
+	}
+	s.size = pos
+	return s.file.Truncate(pos)
+}
+
+func (f *FileStore) active() *segment {
+	return f.segments[len(f.segments)-1]
+}
+
+// roll starts a new segment after the active one.
+func (f *FileStore) roll() error {
+	seg, err := f.openSegment(f.active().end())
+	if err != nil {
+		return err
+	}
+	f.segments = append(f.segments, seg)
+	return nil
+}
+
+func (f *FileStore) Append(entries []*entry.Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if seg := f.active(); seg.size >= f.segmentSize && len(seg.index) > 0 {
+		if err := f.roll(); err != nil {
+			return err
+		}
+	}
+	seg := f.active()
+
+	var buf []byte
+	positions := make([]int64, 0, len(entries))
+	pos := seg.size
+	for _, e := range entries {
+		raw, err := proto.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(len(raw)))
+		buf = append(buf, raw...)
+		positions = append(positions, pos)
+		pos += 4 + int64(len(raw))
+	}
+	if _, err := seg.file.WriteAt(buf, seg.size); err != nil {
+		return err
+	}
+	if err := seg.file.Sync(); err != nil {
+		return err
+	}
+	seg.index = append(seg.index, positions...)
+	seg.size = pos
+	return nil
+}
+
+// Read returns entries from the segment holding offset only, possibly fewer
+// than max.
+func (f *FileStore) Read(offset int64, max int) ([]*entry.Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if offset < f.segments[0].first {
+		return nil, ErrTruncated
+	}
+	i := sort.Search(len(f.segments), func(i int) bool { return f.segments[i].end() > offset })
+	if i == len(f.segments) {
+		return nil, nil
+	}
+	seg := f.segments[i]
+	from := offset - seg.first
+	to := int64(len(seg.index))
+	if max > 0 && to-from > int64(max) {
+		to = from + int64(max)
+	}
+	end := seg.size
+	if to < int64(len(seg.index)) {
+		end = seg.index[to]
+	}
+	buf := make([]byte, end-seg.index[from])
+	if _, err := seg.file.ReadAt(buf, seg.index[from]); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*entry.Entry, 0, to-from)
+	for len(buf) > 0 {
+		n := binary.BigEndian.Uint32(buf)
+		e := &entry.Entry{}
+		if err := proto.Unmarshal(buf[4:4+n], e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+		buf = buf[4+n:]
+	}
+	return entries, nil
+}
+
+func (f *FileStore) Bounds() (int64, int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.segments[0].first, f.active().end()
+}
+
+// Truncate deletes the segments holding only entries before offset. The
+// active segment is replaced by an empty one first when offset covers it
+// too.
+func (f *FileStore) Truncate(offset int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if seg := f.active(); offset >= seg.end() && len(seg.index) > 0 {
+		if err := f.roll(); err != nil {
+			return err
+		}
+	}
+	for len(f.segments) > 1 && f.segments[0].end() <= offset {
+		seg := f.segments[0]
+		_ = seg.file.Close()
+		if err := os.Remove(seg.file.Name()); err != nil {
+			return err
+		}
+		f.segments = f.segments[1:]
+	}
+	return nil
+}
+
+func (f *FileStore) State() (State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return copyState(f.state), nil
+}
+
+// SaveState atomically replaces the state file.
+func (f *FileStore) SaveState(state State) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(f.dir, fileStoreState+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(f.dir, fileStoreState)); err != nil {
+		return err
+	}
+	f.state = copyState(state)
+	return nil
+}
+
+func (f *FileStore) Close() error {
+	var err error
+	for _, seg := range f.segments {
+		if cerr := seg.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func readRange(entries []*entry.Entry, first, offset int64, max int) ([]*entry.Entry, error) {
+	if offset < first {
+		return nil, ErrTruncated
+	}
+	i := offset - first
+	if i >= int64(len(entries)) {
+		return nil, nil
+	}
+	j := int64(len(entries))
+	if max > 0 && j-i > int64(max) {
+		j = i + int64(max)
+	}
+	return entries[i:j], nil
+}
+
+func copyState(state State) State {
+	cursors := make(map[string]int64, len(state.Cursors))
+	for k, v := range state.Cursors {
+		cursors[k] = v
+	}
+	state.Cursors = cursors
+	return state
+}
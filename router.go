@@ -0,0 +1,203 @@
+package canal
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+// RowHandler handles one row change routed by a Router: the rows of an
+// INSERT, UPDATE or DELETE, or the statement of a DDL.
+type RowHandler func(ctx context.Context, event *Event, change *entry.RowChange) error
+
+type routeKind int
+
+const (
+	routeInsert routeKind = iota
+	routeUpdate
+	routeDelete
+	routeDDL
+	routeTruncate
+	routeRename
+)
+
+type route struct {
+	kind  routeKind
+	match func(schema, table string) bool
+	h     RowHandler
+}
+
+// Router dispatches the row changes of a Message to the handlers registered
+// for their table and kind. Every matching handler is called, in the order
+// they were registered; changes no handler matched go to the fallback.
+//
+// Patterns have the form schema.table, where both parts may use the * and ?
+// wildcards, like "shop.orders", "shop.*" or "*.audit_?"; "shop" alone stands
+// for "shop.*". A pattern between slashes, like "/shop_\d+\.orders/", is a
+// regular expression matched against the whole schema.table. Matching ignores
+// case, like canal filters.
+//
+// Router implements Handler, so it can be run by a Consumer. Handlers must be
+// registered before that.
+type Router struct {
+	routes   []route
+	fallback RowHandler
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// OnInsert routes the INSERT row changes of tables matching pattern to h.
+func (r *Router) OnInsert(pattern string, h RowHandler) {
+	r.add(routeInsert, pattern, h)
+}
+
+// OnUpdate routes the UPDATE row changes of tables matching pattern to h.
+func (r *Router) OnUpdate(pattern string, h RowHandler) {
+	r.add(routeUpdate, pattern, h)
+}
+
+// OnDelete routes the DELETE row changes of tables matching pattern to h.
+func (r *Router) OnDelete(pattern string, h RowHandler) {
+	r.add(routeDelete, pattern, h)
+}
+
+// OnDDL routes every DDL statement on tables matching pattern to h,
+// including truncates and renames.
+func (r *Router) OnDDL(pattern string, h RowHandler) {
+	r.add(routeDDL, pattern, h)
+}
+
+// OnTruncate routes the TRUNCATE statements on tables matching pattern to h.
+func (r *Router) OnTruncate(pattern string, h RowHandler) {
+	r.add(routeTruncate, pattern, h)
+}
+
+// OnRename routes the RENAME statements on tables matching pattern to h.
+func (r *Router) OnRename(pattern string, h RowHandler) {
+	r.add(routeRename, pattern, h)
+}
+
+// Fallback sets the handler of the row changes no route matched.
+func (r *Router) Fallback(h RowHandler) {
+	r.fallback = h
+}
+
+// add registers a route. Like http.ServeMux, it panics on an invalid
+// pattern: patterns are part of the program.
+func (r *Router) add(kind routeKind, pattern string, h RowHandler) {
+	match, err := compileTablePattern(pattern)
+	if err != nil {
+		panic("canal: invalid route pattern " + pattern + ": " + err.Error())
+	}
+	r.routes = append(r.routes, route{kind: kind, match: match, h: h})
+}
+
+func compileTablePattern(pattern string) (func(schema, table string) bool, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("(?i)^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return func(schema, table string) bool {
+			return re.MatchString(schema + "." + table)
+		}, nil
+	}
+
+	schemaGlob, tableGlob := strings.ToLower(pattern), "*"
+	if dot := strings.IndexByte(schemaGlob, '.'); dot >= 0 {
+		schemaGlob, tableGlob = schemaGlob[:dot], schemaGlob[dot+1:]
+	}
+	// Reject malformed globs now rather than never matching.
+	if _, err := path.Match(schemaGlob, ""); err != nil {
+		return nil, err
+	}
+	if _, err := path.Match(tableGlob, ""); err != nil {
+		return nil, err
+	}
+	return func(schema, table string) bool {
+		ok, _ := path.Match(schemaGlob, strings.ToLower(schema))
+		if ok {
+			ok, _ = path.Match(tableGlob, strings.ToLower(table))
+		}
+		return ok
+	}, nil
+}
+
+// routeKinds returns the kinds of routes a row change goes to.
+func routeKinds(change *entry.RowChange) []routeKind {
+	switch change.GetEventType() {
+	case entry.EventType_INSERT:
+		return []routeKind{routeInsert}
+	case entry.EventType_UPDATE:
+		return []routeKind{routeUpdate}
+	case entry.EventType_DELETE:
+		return []routeKind{routeDelete}
+	case entry.EventType_TRUNCATE:
+		return []routeKind{routeTruncate, routeDDL}
+	case entry.EventType_RENAME:
+		return []routeKind{routeRename, routeDDL}
+	case entry.EventType_CREATE, entry.EventType_ALTER, entry.EventType_ERASE,
+		entry.EventType_CINDEX, entry.EventType_DINDEX:
+		return []routeKind{routeDDL}
+	}
+	if change.GetIsDdl() {
+		return []routeKind{routeDDL}
+	}
+	return nil
+}
+
+// Handle dispatches the row changes of message, stopping at the first
+// handler error.
+func (r *Router) Handle(ctx context.Context, message *Message) error {
+	events, err := message.Events()
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := r.dispatch(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Router) dispatch(ctx context.Context, event *Event) error {
+	if event.Type != entry.EntryType_ROWDATA {
+		return nil
+	}
+	change, err := event.RowChange()
+	if err != nil {
+		return err
+	}
+	kinds := routeKinds(change)
+	schema, table := event.Header.GetSchemaName(), event.Header.GetTableName()
+
+	matched := false
+	for _, rt := range r.routes {
+		if !hasKind(kinds, rt.kind) || !rt.match(schema, table) {
+			continue
+		}
+		matched = true
+		if err := rt.h(ctx, event, change); err != nil {
+			return err
+		}
+	}
+	if !matched && r.fallback != nil {
+		return r.fallback(ctx, event, change)
+	}
+	return nil
+}
+
+func hasKind(kinds []routeKind, kind routeKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
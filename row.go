@@ -0,0 +1,347 @@
+package canal
+
+import (
+	"database/sql"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+var (
+	ErrUnknownColumn = errors.New("column has no matching struct field")
+)
+
+// Strictness decides how a RowDecoder reports columns it cannot store.
+type Strictness int
+
+const (
+	// IgnoreUnknownColumns skips columns without a matching field but fails on
+	// values that do not convert to their field. It is the default.
+	IgnoreUnknownColumns Strictness = iota
+	// StrictColumns fails on both.
+	StrictColumns
+	// LenientColumns skips both, leaving the fields of values that do not
+	// convert untouched.
+	LenientColumns
+)
+
+// ColumnError reports a column a RowDecoder could not store.
+type ColumnError struct {
+	Column string
+	// Field is the name of the struct field, empty for unknown columns.
+	Field string
+	Err   error
+}
+
+func (e *ColumnError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("column %s: %v", e.Column, e.Err)
+	}
+	return fmt.Sprintf("column %s into field %s: %v", e.Column, e.Field, e.Err)
+}
+
+func (e *ColumnError) Unwrap() error {
+	return e.Err
+}
+
+// RowDecoder stores row images into structs. Columns go to the field tagged
+// `canal:"column_name"`, or else to the field whose name equals the column
+// name ignoring case. Fields tagged `canal:"-"` are left alone.
+//
+// Fields may be of the type ColumnConverter gives the column, of any other
+// numeric, string, []byte or bool type the value converts to, pointers to
+// those (nil for NULL), or implement sql.Scanner or encoding.TextUnmarshaler.
+type RowDecoder struct {
+	Converter  ColumnConverter
+	Strictness Strictness
+}
+
+// UnmarshalRow stores columns into the struct v points to with the zero
+// RowDecoder.
+func UnmarshalRow(columns []*entry.Column, v interface{}) error {
+	return RowDecoder{}.Unmarshal(columns, v)
+}
+
+// UnmarshalBefore stores the before image of row, that of deleted and
+// updated rows, into v.
+func UnmarshalBefore(row *entry.RowData, v interface{}) error {
+	return RowDecoder{}.Unmarshal(row.GetBeforeColumns(), v)
+}
+
+// UnmarshalAfter stores the after image of row, that of inserted and updated
+// rows, into v.
+func UnmarshalAfter(row *entry.RowData, v interface{}) error {
+	return RowDecoder{}.Unmarshal(row.GetAfterColumns(), v)
+}
+
+func (d RowDecoder) UnmarshalBefore(row *entry.RowData, v interface{}) error {
+	return d.Unmarshal(row.GetBeforeColumns(), v)
+}
+
+func (d RowDecoder) UnmarshalAfter(row *entry.RowData, v interface{}) error {
+	return d.Unmarshal(row.GetAfterColumns(), v)
+}
+
+// Unmarshal stores columns into the struct v points to.
+func (d RowDecoder) Unmarshal(columns []*entry.Column, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("canal: UnmarshalRow needs a non-nil struct pointer, got %T", v)
+	}
+	fields := rowFieldsOf(rv.Elem().Type())
+
+	for _, col := range columns {
+		f, ok := fields.byColumn[strings.ToLower(col.GetName())]
+		if !ok {
+			if d.Strictness == StrictColumns {
+				return &ColumnError{Column: col.GetName(), Err: ErrUnknownColumn}
+			}
+			continue
+		}
+		if err := d.store(rv.Elem().FieldByIndex(f.index), col); err != nil {
+			if d.Strictness == LenientColumns {
+				continue
+			}
+			return &ColumnError{Column: col.GetName(), Field: f.name, Err: err}
+		}
+	}
+	return nil
+}
+
+// ChangedFields returns the names of the fields of v, a struct or a pointer
+// to one, whose column the UPDATE row changed.
+func ChangedFields(row *entry.RowData, v interface{}) ([]string, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("canal: ChangedFields needs a struct, got %T", v)
+	}
+	fields := rowFieldsOf(t)
+
+	var changed []string
+	for _, col := range row.GetAfterColumns() {
+		if !col.GetUpdated() {
+			continue
+		}
+		if f, ok := fields.byColumn[strings.ToLower(col.GetName())]; ok {
+			changed = append(changed, f.name)
+		}
+	}
+	return changed, nil
+}
+
+type rowField struct {
+	name  string
+	index []int
+}
+
+type rowFields struct {
+	byColumn map[string]rowField
+}
+
+// rowFieldCache maps struct types to their *rowFields.
+var rowFieldCache sync.Map
+
+func rowFieldsOf(t reflect.Type) *rowFields {
+	if fields, ok := rowFieldCache.Load(t); ok {
+		return fields.(*rowFields)
+	}
+	fields := &rowFields{byColumn: make(map[string]rowField)}
+	collectRowFields(fields, t, nil)
+	actual, _ := rowFieldCache.LoadOrStore(t, fields)
+	return actual.(*rowFields)
+}
+
+func collectRowFields(fields *rowFields, t reflect.Type, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("canal")
+		if tag == "-" {
+			continue
+		}
+		path := append(append([]int(nil), index...), i)
+		// Untagged embedded structs contribute their own fields.
+		if sf.Anonymous && tag == "" && sf.Type.Kind() == reflect.Struct {
+			collectRowFields(fields, sf.Type, path)
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		column := tag
+		if column == "" {
+			column = sf.Name
+		}
+		column = strings.ToLower(column)
+		// Shallower fields win over embedded ones, then the first one.
+		if f, ok := fields.byColumn[column]; !ok || len(path) < len(f.index) {
+			fields.byColumn[column] = rowField{name: sf.Name, index: path}
+		}
+	}
+}
+
+var (
+	scannerType         = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+func (d RowDecoder) store(field reflect.Value, col *entry.Column) error {
+	value, err := d.Converter.value(col)
+	if err != nil {
+		return err
+	}
+
+	if field.CanAddr() && field.Addr().Type().Implements(scannerType) {
+		return field.Addr().Interface().(sql.Scanner).Scan(driverValue(value, col))
+	}
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	if field.Kind() == reflect.Ptr {
+		elem := reflect.New(field.Type().Elem())
+		if err := assign(elem.Elem(), value, col.GetValue()); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+	return assign(field, value, col.GetValue())
+}
+
+// assign stores value, converted from the column text raw, into field.
+func assign(field reflect.Value, value interface{}, raw string) error {
+	rv := reflect.ValueOf(value)
+	if rv.Type().AssignableTo(field.Type()) {
+		field.Set(rv)
+		return nil
+	}
+	if field.CanAddr() && field.Addr().Type().Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(raw))
+	}
+
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch v := value.(type) {
+		case int64:
+			n = v
+		case uint64:
+			if v > math.MaxInt64 {
+				return fmt.Errorf("%d overflows %v", v, field.Type())
+			}
+			n = int64(v)
+		case bool:
+			if v {
+				n = 1
+			}
+		case time.Duration:
+			n = int64(v)
+		default:
+			return fmt.Errorf("cannot store %T in %v", value, field.Type())
+		}
+		if field.OverflowInt(n) {
+			return fmt.Errorf("%d overflows %v", n, field.Type())
+		}
+		field.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		switch v := value.(type) {
+		case uint64:
+			n = v
+		case int64:
+			if v < 0 {
+				return fmt.Errorf("%d overflows %v", v, field.Type())
+			}
+			n = uint64(v)
+		case bool:
+			if v {
+				n = 1
+			}
+		default:
+			return fmt.Errorf("cannot store %T in %v", value, field.Type())
+		}
+		if field.OverflowUint(n) {
+			return fmt.Errorf("%d overflows %v", n, field.Type())
+		}
+		field.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch v := value.(type) {
+		case float32:
+			f = float64(v)
+		case float64:
+			f = v
+		case int64:
+			f = float64(v)
+		case uint64:
+			f = float64(v)
+		case Decimal:
+			f = v.Float64()
+		default:
+			return fmt.Errorf("cannot store %T in %v", value, field.Type())
+		}
+		field.SetFloat(f)
+
+	case reflect.Bool:
+		switch v := value.(type) {
+		case int64:
+			field.SetBool(v != 0)
+		case uint64:
+			field.SetBool(v != 0)
+		default:
+			return fmt.Errorf("cannot store %T in %v", value, field.Type())
+		}
+
+	case reflect.String:
+		field.SetString(raw)
+
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("cannot store %T in %v", value, field.Type())
+		}
+		switch v := value.(type) {
+		case json.RawMessage:
+			field.SetBytes(v)
+		default:
+			field.SetBytes([]byte(raw))
+		}
+
+	default:
+		return fmt.Errorf("cannot store %T in %v", value, field.Type())
+	}
+	return nil
+}
+
+// driverValue turns value into one of the types sql.Scanner implementations
+// expect.
+func driverValue(value interface{}, col *entry.Column) interface{} {
+	switch v := value.(type) {
+	case nil, int64, float64, bool, []byte, string, time.Time:
+		return v
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+		return strconv.FormatUint(v, 10)
+	case float32:
+		return float64(v)
+	case json.RawMessage:
+		return []byte(v)
+	default:
+		return col.GetValue()
+	}
+}
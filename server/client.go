@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+// clientState is what the server knows about one clientId of a destination:
+// its subscription, the batches it fetched but did not ack yet and the cursor
+// up to which it acked.
+type clientState struct {
+	destination string
+	clientID    string
+
+	mu          sync.Mutex
+	subscribed  bool
+	filter      *canal.Filter
+	acked       Cursor
+	next        Cursor
+	nextBatchID int64
+	outstanding []batch
+}
+
+type batch struct {
+	id  int64
+	end Cursor
+}
+
+func newClientState(destination, clientID string, cursor Cursor) *clientState {
+	return &clientState{
+		destination: destination,
+		clientID:    clientID,
+		acked:       cursor,
+		next:        cursor,
+		nextBatchID: 1,
+	}
+}
+
+func (c *clientState) subscribe(filter string) error {
+	f, err := canal.ParseFilter(filter)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = true
+	c.filter = f
+	return nil
+}
+
+func (c *clientState) unsubscribe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = false
+}
+
+func (c *clientState) info() ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := ClientInfo{
+		Subscribed: c.subscribed,
+		Acked:      c.acked,
+	}
+	if c.filter != nil {
+		info.Filter = c.filter.String()
+	}
+	for _, b := range c.outstanding {
+		info.Outstanding = append(info.Outstanding, b.id)
+	}
+	return info
+}
+
+// get fetches the next batch after the outstanding ones. Entries rejected by
+// the subscription filter are skipped but still covered by the batch, so that
+// acking it moves the cursor past them. It returns batch ID -1 when nothing
+// matching shows up before ctx is done.
+//
+// The source is polled without holding mu, so that acks and rollbacks are
+// not held up by a long poll.
+func (c *clientState) get(ctx context.Context, source EntrySource, size int) (int64, []*entry.Entry, error) {
+	c.mu.Lock()
+	if !c.subscribed {
+		c.mu.Unlock()
+		return 0, nil, fmt.Errorf("ClientIdentity:%s should subscribe first", c.clientID)
+	}
+	start, filter := c.next, c.filter
+	c.mu.Unlock()
+
+	cursor := start
+	var entries []*entry.Entry
+	for len(entries) == 0 {
+		fetched, end, err := source.Fetch(ctx, c.destination, cursor, size)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(fetched) == 0 {
+			break
+		}
+		cursor = end
+		for _, e := range fetched {
+			header := e.GetHeader()
+			if filter.Matches(header.GetSchemaName(), header.GetTableName()) {
+				entries = append(entries, e)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.next != start {
+		// A rollback, or a Get of the same clientId on another connection,
+		// moved the cursor meanwhile: what was fetched may not follow it.
+		return -1, nil, nil
+	}
+	if len(entries) == 0 {
+		// Only filtered out entries were seen. With nothing outstanding they
+		// can be acked right away, otherwise they are fetched again later.
+		if cursor != c.next && len(c.outstanding) == 0 {
+			if err := source.Commit(c.destination, c.clientID, cursor); err != nil {
+				return 0, nil, err
+			}
+			c.acked = cursor
+			c.next = cursor
+		}
+		return -1, nil, nil
+	}
+
+	id := c.nextBatchID
+	c.nextBatchID++
+	c.outstanding = append(c.outstanding, batch{id: id, end: cursor})
+	c.next = cursor
+	return id, entries, nil
+}
+
+// ack acknowledges the oldest outstanding batch, which must be batchID.
+func (c *clientState) ack(source EntrySource, batchID int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.outstanding) == 0 {
+		return fmt.Errorf("batchId:%d is not exist , please check", batchID)
+	}
+	if first := c.outstanding[0].id; first != batchID {
+		return fmt.Errorf("batchId:%d is not the firstly:%d", batchID, first)
+	}
+	end := c.outstanding[0].end
+	if err := source.Commit(c.destination, c.clientID, end); err != nil {
+		return err
+	}
+	c.outstanding = c.outstanding[1:]
+	c.acked = end
+	return nil
+}
+
+// rollback makes every outstanding batch available again.
+func (c *clientState) rollback() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outstanding = nil
+	c.next = c.acked
+}
+
+// seek moves the client to cursor, forgetting the outstanding batches.
+func (c *clientState) seek(cursor Cursor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outstanding = nil
+	c.acked = cursor
+	c.next = cursor
+}
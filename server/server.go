@@ -0,0 +1,582 @@
+// Package server implements the server side of the canal protocol, so that
+// any change source can be consumed by existing canal clients.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/protobuf/protocol"
+
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrServerClosed = errors.New("canal server closed")
+)
+
+type serverOptions struct {
+	auth         Authenticator
+	compression  protocol.Compression
+	maxBatchSize int
+	interceptor  Interceptor
+	logger       canal.Logger
+}
+
+func defaultServerOptions() serverOptions {
+	return serverOptions{
+		compression:  protocol.Compression_NONE,
+		maxBatchSize: 10000,
+		logger:       canal.NopLogger(),
+	}
+}
+
+// Option configures a Server.
+type Option interface {
+	apply(*serverOptions)
+}
+
+type funcOption struct {
+	f func(*serverOptions)
+}
+
+func (fo *funcOption) apply(o *serverOptions) {
+	fo.f(o)
+}
+
+func newFuncOption(f func(*serverOptions)) *funcOption {
+	return &funcOption{
+		f: f,
+	}
+}
+
+// WithAuthenticator makes clients authenticate. Without it any client is
+// accepted.
+func WithAuthenticator(auth Authenticator) Option {
+	return newFuncOption(func(o *serverOptions) {
+		o.auth = auth
+	})
+}
+
+// WithCompression advertises c in the handshake and compresses MESSAGES
+// packets with it.
+func WithCompression(c protocol.Compression) Option {
+	return newFuncOption(func(o *serverOptions) {
+		o.compression = c
+	})
+}
+
+// WithMaxBatchSize caps the number of entries of a batch, whatever the fetch
+// size a client asks for.
+func WithMaxBatchSize(n int) Option {
+	return newFuncOption(func(o *serverOptions) {
+		o.maxBatchSize = n
+	})
+}
+
+// HandlerFunc handles one packet received from a client and returns the
+// reply to send, if any. An error closes the connection, after sending the
+// reply if there is one.
+type HandlerFunc func(p *protocol.Packet) (*protocol.Packet, error)
+
+// Interceptor wraps the handling of every packet received from clients,
+// authentication included; next is the handling of the server. It can
+// observe packets and their outcome, answer them itself or close the
+// connection, for instance to inject failures in tests.
+type Interceptor func(p *protocol.Packet, next HandlerFunc) (*protocol.Packet, error)
+
+func WithInterceptor(i Interceptor) Option {
+	return newFuncOption(func(o *serverOptions) {
+		o.interceptor = i
+	})
+}
+
+// WithLogger reports connections and protocol errors to logger. Nothing is
+// logged by default, nor when logger is nil.
+func WithLogger(logger canal.Logger) Option {
+	return newFuncOption(func(o *serverOptions) {
+		if logger == nil {
+			logger = canal.NopLogger()
+		}
+		o.logger = logger
+	})
+}
+
+// Server speaks the canal protocol on behalf of an EntrySource. It tracks the
+// subscription, the outstanding batches and the ack cursor of every clientId
+// of every destination; a client reconnecting with the same clientId resumes
+// where it left off.
+type Server struct {
+	source EntrySource
+	opts   serverOptions
+
+	mu          sync.Mutex
+	compression protocol.Compression
+	listeners   map[net.Listener]struct{}
+	conns       map[net.Conn]struct{}
+	clients     map[clientKey]*clientState
+	closed      bool
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+type clientKey struct {
+	destination string
+	clientID    string
+}
+
+func New(source EntrySource, opts ...Option) *Server {
+	s := &Server{
+		source:    source,
+		opts:      defaultServerOptions(),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		clients:   make(map[clientKey]*clientState),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt.apply(&s.opts)
+	}
+	s.compression = s.opts.compression
+	return s
+}
+
+// SetCompression changes the compression of the connections accepted from
+// now on, see WithCompression.
+func (s *Server) SetCompression(c protocol.Compression) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compression = c
+}
+
+// ClientInfo is what the server knows about one clientId of a destination.
+type ClientInfo struct {
+	Subscribed bool
+	Filter     string
+	// Acked is the cursor up to which the client acknowledged entries.
+	Acked Cursor
+	// Outstanding lists the batches fetched but neither acked nor rolled
+	// back yet, oldest first.
+	Outstanding []int64
+}
+
+// Client reports the state of clientID on destination, if it ever showed up.
+func (s *Server) Client(destination, clientID string) (ClientInfo, bool) {
+	s.mu.Lock()
+	client, ok := s.clients[clientKey{destination: destination, clientID: clientID}]
+	s.mu.Unlock()
+	if !ok {
+		return ClientInfo{}, false
+	}
+	return client.info(), true
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients until the
+// server is closed.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until the server is closed, and then
+// returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+				return err
+			}
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// Close stops every listener, closes every connection and waits for their
+// handlers to return. Outstanding batches are forgotten, clients get them
+// again after reconnecting to a new server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// session is the state of one client connection.
+type session struct {
+	conn          net.Conn
+	seed          []byte
+	compression   protocol.Compression
+	authenticated bool
+	username      string
+	destination   string
+	clientID      string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	sess := &session{
+		conn: conn,
+		seed: make([]byte, 8),
+	}
+	_, _ = rand.Read(sess.seed)
+	s.mu.Lock()
+	sess.compression = s.compression
+	s.mu.Unlock()
+	log := s.opts.logger
+	handle := func(p *protocol.Packet) (*protocol.Packet, error) {
+		return s.dispatch(sess, p)
+	}
+	if s.opts.interceptor != nil {
+		next := handle
+		handle = func(p *protocol.Packet) (*protocol.Packet, error) {
+			return s.opts.interceptor(p, next)
+		}
+	}
+
+	handshake := &protocol.Handshake{
+		Seeds:                 sess.seed,
+		SupportedCompressions: sess.compression,
+	}
+	packet := &protocol.Packet{
+		VersionPresent: &protocol.Packet_Version{Version: 1},
+		Type:           protocol.PacketType_HANDSHAKE,
+	}
+	packet.Body, _ = proto.Marshal(handshake)
+	if err := packet.Write(conn); err != nil {
+		return
+	}
+
+	for {
+		packet := &protocol.Packet{}
+		if err := packet.Read(conn); err != nil {
+			return
+		}
+		reply, err := handle(packet)
+		if err != nil {
+			log.Warn("closing client connection", canal.F("remote", conn.RemoteAddr().String()),
+				canal.F("destination", sess.destination), canal.F("clientId", sess.clientID), canal.F("error", err))
+			if reply != nil {
+				_ = reply.Write(conn)
+			}
+			return
+		}
+		if reply == nil {
+			continue
+		}
+		if err := reply.Write(conn); err != nil {
+			return
+		}
+	}
+}
+
+var errNotAuthenticated = errors.New("client is not authenticated")
+
+// dispatch handles one request and returns the reply to send, if any. An
+// error closes the connection, after sending the reply if there is one.
+func (s *Server) dispatch(sess *session, p *protocol.Packet) (*protocol.Packet, error) {
+	if !sess.authenticated && p.GetType() != protocol.PacketType_CLIENTAUTHENTICATION {
+		return ErrorAck(400, errNotAuthenticated.Error()), errNotAuthenticated
+	}
+
+	switch p.GetType() {
+	case protocol.PacketType_CLIENTAUTHENTICATION:
+		var auth protocol.ClientAuth
+		if err := proto.Unmarshal(p.GetBody(), &auth); err != nil {
+			return nil, err
+		}
+		return s.authenticate(sess, &auth)
+
+	case protocol.PacketType_SUBSCRIPTION:
+		var sub protocol.Sub
+		if err := proto.Unmarshal(p.GetBody(), &sub); err != nil {
+			return nil, err
+		}
+		client, err := s.client(sub.GetDestination(), sub.GetClientId())
+		if err != nil {
+			return errorReply(err), nil
+		}
+		if err := client.subscribe(sub.GetFilter()); err != nil {
+			return ErrorAck(400, "subscribe failed: "+err.Error()), nil
+		}
+		s.opts.logger.Info("client subscribed", canal.F("destination", sub.GetDestination()),
+			canal.F("clientId", sub.GetClientId()), canal.F("filter", sub.GetFilter()))
+		return okAck(), nil
+
+	case protocol.PacketType_UNSUBSCRIPTION:
+		var unsub protocol.Unsub
+		if err := proto.Unmarshal(p.GetBody(), &unsub); err != nil {
+			return nil, err
+		}
+		client, err := s.client(unsub.GetDestination(), unsub.GetClientId())
+		if err != nil {
+			return errorReply(err), nil
+		}
+		client.unsubscribe()
+		return okAck(), nil
+
+	case protocol.PacketType_GET:
+		var get protocol.Get
+		if err := proto.Unmarshal(p.GetBody(), &get); err != nil {
+			return nil, err
+		}
+		return s.get(sess, &get)
+
+	case protocol.PacketType_CLIENTACK:
+		var ack protocol.ClientAck
+		if err := proto.Unmarshal(p.GetBody(), &ack); err != nil {
+			return nil, err
+		}
+		switch ack.GetBatchId() {
+		case 0:
+			return ErrorAck(402, "batchId should assign value"), nil
+		case -1:
+			// -1 acknowledges an empty Get, there is nothing to do.
+			return nil, nil
+		}
+		client, err := s.client(ack.GetDestination(), ack.GetClientId())
+		if err != nil {
+			return errorReply(err), nil
+		}
+		if err := client.ack(s.source, ack.GetBatchId()); err != nil {
+			return errorReply(err), nil
+		}
+		return nil, nil
+
+	case protocol.PacketType_CLIENTROLLBACK:
+		var rollback protocol.ClientRollback
+		if err := proto.Unmarshal(p.GetBody(), &rollback); err != nil {
+			return nil, err
+		}
+		client, err := s.client(rollback.GetDestination(), rollback.GetClientId())
+		if err != nil {
+			return errorReply(err), nil
+		}
+		client.rollback()
+		return nil, nil
+
+	case protocol.PacketType_HEARTBEAT:
+		return &protocol.Packet{Type: protocol.PacketType_HEARTBEAT, Body: p.GetBody()}, nil
+
+	default:
+		// Like the Java server, answer and hang up.
+		err := fmt.Errorf("packet type=%s is NOT supported!", p.GetType())
+		return ErrorAck(400, err.Error()), err
+	}
+}
+
+func (s *Server) authenticate(sess *session, auth *protocol.ClientAuth) (*protocol.Packet, error) {
+	if s.opts.auth != nil {
+		scrambled, err := hex.DecodeString(string(auth.GetPassword()))
+		if err == nil {
+			err = s.opts.auth.Authenticate(auth.GetUsername(), scrambled, sess.seed, auth.GetDestination())
+		}
+		if err != nil {
+			s.opts.logger.Warn("client authentication failed", canal.F("remote", sess.conn.RemoteAddr().String()),
+				canal.F("username", auth.GetUsername()), canal.F("error", err))
+			// Like the Java server, answer and let the client decide to hang up.
+			return ErrorAck(400, "auth failed for user:"+auth.GetUsername()), nil
+		}
+	}
+	if auth.GetStartTimestamp() > 0 {
+		if err := s.seek(auth); err != nil {
+			return errorReply(err), nil
+		}
+	}
+	sess.authenticated = true
+	sess.username = auth.GetUsername()
+	sess.destination = auth.GetDestination()
+	sess.clientID = auth.GetClientId()
+	return okAck(), nil
+}
+
+func (s *Server) get(sess *session, get *protocol.Get) (*protocol.Packet, error) {
+	client, err := s.client(get.GetDestination(), get.GetClientId())
+	if err != nil {
+		return errorReply(err), nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if timeout := get.GetTimeout(); get.GetTimeoutPresent() != nil && timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*timeUnit(get.GetUnit()))
+		defer cancel()
+	} else {
+		// Without a timeout the client wants whatever is available now.
+		cancel()
+	}
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	size := int(get.GetFetchSize())
+	if size <= 0 || size > s.opts.maxBatchSize {
+		size = s.opts.maxBatchSize
+	}
+	batchID, entries, err := client.get(ctx, s.source, size)
+	if err != nil {
+		return errorReply(err), nil
+	}
+	if get.GetAutoAck() && batchID > 0 {
+		if err := client.ack(s.source, batchID); err != nil {
+			return errorReply(err), nil
+		}
+	}
+
+	messages := &protocol.Messages{BatchId: batchID}
+	for _, e := range entries {
+		raw, err := proto.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		messages.Messages = append(messages.Messages, raw)
+	}
+	packet := &protocol.Packet{Type: protocol.PacketType_MESSAGES}
+	if packet.Body, err = proto.Marshal(messages); err != nil {
+		return nil, err
+	}
+	if err := packet.CompressBody(sess.compression); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// seek positions the client authenticating with auth at its start timestamp,
+// when the source supports it.
+func (s *Server) seek(auth *protocol.ClientAuth) error {
+	seeker, ok := s.source.(Seeker)
+	if !ok {
+		s.opts.logger.Warn("start timestamp ignored, the source cannot seek",
+			canal.F("destination", auth.GetDestination()), canal.F("clientId", auth.GetClientId()))
+		return nil
+	}
+	client, err := s.client(auth.GetDestination(), auth.GetClientId())
+	if err != nil {
+		return err
+	}
+	cursor, err := seeker.Seek(auth.GetDestination(), auth.GetStartTimestamp())
+	if err != nil {
+		return err
+	}
+	client.seek(cursor)
+	return nil
+}
+
+// client returns the state of clientID on destination, loading its committed
+// cursor from the source the first time.
+func (s *Server) client(destination, clientID string) (*clientState, error) {
+	key := clientKey{destination: destination, clientID: clientID}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client, ok := s.clients[key]; ok {
+		return client, nil
+	}
+	cursor, err := s.source.Cursor(destination, clientID)
+	if err != nil {
+		return nil, err
+	}
+	client := newClientState(destination, clientID, cursor)
+	s.clients[key] = client
+	return client, nil
+}
+
+// timeUnit maps the unit of a Get, a java.util.concurrent.TimeUnit ordinal,
+// to its duration.
+func timeUnit(unit int32) time.Duration {
+	switch unit {
+	case 0:
+		return time.Nanosecond
+	case 1:
+		return time.Microsecond
+	case 2:
+		return time.Millisecond
+	case 3:
+		return time.Second
+	case 4:
+		return time.Minute
+	case 5:
+		return time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+func okAck() *protocol.Packet {
+	return ackPacket(&protocol.Ack{})
+}
+
+// ErrorAck builds the Ack packet the server answers a failed request with.
+func ErrorAck(code int32, message string) *protocol.Packet {
+	return ackPacket(&protocol.Ack{
+		ErrorCodePresent: &protocol.Ack_ErrorCode{ErrorCode: code},
+		ErrorMessage:     message,
+	})
+}
+
+// errorReply reports err to the client. Errors of this package are worded
+// like the Java server's, so that clients classify them.
+func errorReply(err error) *protocol.Packet {
+	return ErrorAck(400, err.Error())
+}
+
+func ackPacket(ack *protocol.Ack) *protocol.Packet {
+	body, _ := proto.Marshal(ack)
+	return &protocol.Packet{
+		Type: protocol.PacketType_ACK,
+		Body: body,
+	}
+}
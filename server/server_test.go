@@ -0,0 +1,200 @@
+package server_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/canaltest"
+	"github.com/katakurin/canal/protobuf/entry"
+	"github.com/katakurin/canal/protobuf/protocol"
+	"github.com/katakurin/canal/server"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func serve(t *testing.T, source server.EntrySource, opts ...server.Option) (*server.Server, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(source, opts...)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return srv, l.Addr().String()
+}
+
+func connect(t *testing.T, addr string, opts ...canal.ClientOption) *canal.Client {
+	t.Helper()
+	client, err := canal.NewClient(addr, "example", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+	if err := client.Subscribe("db\\..*"); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestServerGetAckRollback(t *testing.T) {
+	source := server.NewMemorySource()
+	source.Append("example",
+		canaltest.RowEntry("db", "orders", entry.EventType_INSERT),
+		canaltest.RowEntry("other", "logs", entry.EventType_INSERT),
+		canaltest.RowEntry("db", "users", entry.EventType_UPDATE),
+		canaltest.RowEntry("other", "logs", entry.EventType_INSERT),
+	)
+	srv, addr := serve(t, source)
+	client := connect(t, addr)
+
+	message, err := client.GetWithOutAck(3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != 1 || message.Len() != 2 {
+		t.Fatalf("got batch %d with %d entries, want batch 1 with the 2 db entries", message.ID, message.Len())
+	}
+	if err := client.Rollback(message.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	message, err = client.GetWithOutAck(3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != 2 || message.Len() != 2 {
+		t.Fatalf("after rollback got batch %d with %d entries, want batch 2 with 2 entries", message.ID, message.Len())
+	}
+	if err := client.Ack(message.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a filtered out entry is left, it is acked without a batch.
+	message, err = client.GetWithOutAck(3, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != -1 {
+		t.Fatalf("got batch %d, want -1", message.ID)
+	}
+	info, ok := srv.Client("example", "1001")
+	if !ok || !info.Subscribed || info.Filter != "db\\..*" {
+		t.Fatalf("client info = %+v, %v", info, ok)
+	}
+	if info.Acked != "4" || len(info.Outstanding) != 0 {
+		t.Fatalf("acked %q with %v outstanding, want 4 with none", info.Acked, info.Outstanding)
+	}
+	if cursor, _ := source.Cursor("example", "1001"); cursor != "4" {
+		t.Fatalf("committed cursor = %q, want 4", cursor)
+	}
+}
+
+func TestServerLongPollDoesNotBlockAck(t *testing.T) {
+	source := server.NewMemorySource()
+	source.Append("example", canaltest.RowEntry("db", "orders", entry.EventType_INSERT))
+	srv, addr := serve(t, source)
+	first := connect(t, addr)
+	second := connect(t, addr)
+
+	message, err := first.GetWithOutAck(10, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same clientId polls on another connection while the batch is acked.
+	const poll = 2 * time.Second
+	polled := make(chan error, 1)
+	go func() {
+		_, err := second.GetWithOutAck(10, poll)
+		polled <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	if err := first.Ack(message.ID); err != nil {
+		t.Fatal(err)
+	}
+	// The ack is fire-and-forget, a second exchange makes sure it was handled.
+	if _, err := first.GetWithOutAck(10, -1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > poll/2 {
+		t.Fatalf("ack took %v, it waited for the long poll", elapsed)
+	}
+	if info, _ := srv.Client("example", "1001"); len(info.Outstanding) != 0 {
+		t.Fatalf("outstanding = %v, want none", info.Outstanding)
+	}
+	if err := <-polled; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerAuthentication(t *testing.T) {
+	_, addr := serve(t, server.NewMemorySource(),
+		server.WithAuthenticator(server.StaticCredentials("canal", "secret")))
+
+	_, err := canal.NewClient(addr, "example", canal.WithCredentials("canal", "wrong"))
+	if !errors.Is(err, canal.ErrAuthFailed) {
+		t.Fatalf("err = %v, want ErrAuthFailed", err)
+	}
+	connect(t, addr, canal.WithCredentials("canal", "secret"))
+}
+
+func TestServerRejectsUnsupportedPacket(t *testing.T) {
+	_, addr := serve(t, server.NewMemorySource())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	exchange := func(typ protocol.PacketType, body proto.Message) *protocol.Ack {
+		t.Helper()
+		p := &protocol.Packet{Type: typ}
+		p.Body, _ = proto.Marshal(body)
+		if err := p.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		reply := &protocol.Packet{}
+		if err := reply.Read(conn); err != nil {
+			t.Fatal(err)
+		}
+		var ack protocol.Ack
+		if err := proto.Unmarshal(reply.GetBody(), &ack); err != nil {
+			t.Fatal(err)
+		}
+		return &ack
+	}
+
+	if err := (&protocol.Packet{}).Read(conn); err != nil {
+		t.Fatal(err)
+	}
+	if ack := exchange(protocol.PacketType_CLIENTAUTHENTICATION, &protocol.ClientAuth{Destination: "example", ClientId: "1001"}); ack.GetErrorCode() != 0 {
+		t.Fatalf("authentication failed: %v", ack)
+	}
+	if ack := exchange(protocol.PacketType_DUMP, &protocol.Dump{Journal: "mysql-bin.000001"}); ack.GetErrorCode() != 400 {
+		t.Fatalf("DUMP answered with %v, want an error", ack)
+	}
+	if err := (&protocol.Packet{}).Read(conn); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after DUMP = %v, want the connection closed", err)
+	}
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	_, addr := serve(t, server.NewMemorySource())
+	client := connect(t, addr)
+
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.RTT() != rtt || !client.Connected() {
+		t.Fatalf("RTT() = %v after a %v ping, connected %v", client.RTT(), rtt, client.Connected())
+	}
+}
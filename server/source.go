@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/katakurin/canal"
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+// Cursor is an opaque position in the entry stream of a destination, chosen
+// by the EntrySource. The empty cursor is the beginning of the stream.
+type Cursor string
+
+// EntrySource supplies the entries the server hands out to its clients.
+type EntrySource interface {
+	// Fetch returns up to max entries of destination that follow cursor,
+	// together with the cursor right after the last of them. When none is
+	// available it waits until ctx is done and returns no entries.
+	Fetch(ctx context.Context, destination string, cursor Cursor, max int) ([]*entry.Entry, Cursor, error)
+	// Commit is called once clientID has acknowledged every entry of
+	// destination up to cursor.
+	Commit(destination, clientID string, cursor Cursor) error
+	// Cursor returns the last cursor committed by clientID, where it resumes
+	// after a restart.
+	Cursor(destination, clientID string) (Cursor, error)
+}
+
+// Seeker is implemented by sources that can position a client at a
+// timestamp, as requested by the StartTimestamp of its ClientAuth. The
+// timestamp is in milliseconds since the epoch.
+type Seeker interface {
+	Seek(destination string, timestamp int64) (Cursor, error)
+}
+
+// Authenticator decides whether a client may connect.
+type Authenticator interface {
+	// Authenticate checks the Scramble411 token a client computed from its
+	// password and seed.
+	Authenticate(username string, scrambled, seed []byte, destination string) error
+}
+
+var (
+	ErrUnknownDestination = errors.New("destination is not exist")
+	errAuthFailed         = errors.New("auth failed")
+)
+
+type staticCredentials struct {
+	username     string
+	passwordHash []byte
+}
+
+// StaticCredentials accepts a single username and password.
+func StaticCredentials(username, password string) Authenticator {
+	return &staticCredentials{
+		username:     username,
+		passwordHash: canal.PasswordSHA1SHA1([]byte(password)),
+	}
+}
+
+func (a *staticCredentials) Authenticate(username string, scrambled, seed []byte, destination string) error {
+	if username != a.username || !canal.CheckScramble411(scrambled, seed, a.passwordHash) {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// MemorySource is an in-memory, append-only EntrySource. Cursors are entry
+// offsets in the stream of each destination. Committed cursors are kept in
+// memory only.
+type MemorySource struct {
+	mu        sync.Mutex
+	streams   map[string]*memoryStream
+	committed map[string]Cursor
+}
+
+type memoryStream struct {
+	entries []*entry.Entry
+	// notify is closed and replaced whenever entries are appended.
+	notify chan struct{}
+}
+
+func NewMemorySource() *MemorySource {
+	return &MemorySource{
+		streams:   make(map[string]*memoryStream),
+		committed: make(map[string]Cursor),
+	}
+}
+
+// Append adds entries to the stream of destination and wakes up waiting
+// fetches.
+func (m *MemorySource) Append(destination string, entries ...*entry.Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stream := m.stream(destination)
+	stream.entries = append(stream.entries, entries...)
+	close(stream.notify)
+	stream.notify = make(chan struct{})
+}
+
+func (m *MemorySource) stream(destination string) *memoryStream {
+	stream, ok := m.streams[destination]
+	if !ok {
+		stream = &memoryStream{notify: make(chan struct{})}
+		m.streams[destination] = stream
+	}
+	return stream
+}
+
+func (m *MemorySource) Fetch(ctx context.Context, destination string, cursor Cursor, max int) ([]*entry.Entry, Cursor, error) {
+	offset, err := memoryOffset(cursor)
+	if err != nil {
+		return nil, cursor, err
+	}
+
+	m.mu.Lock()
+	stream := m.stream(destination)
+	for offset >= len(stream.entries) {
+		notify := stream.notify
+		m.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, cursor, nil
+		case <-notify:
+		}
+		m.mu.Lock()
+	}
+	end := len(stream.entries)
+	if max > 0 && end-offset > max {
+		end = offset + max
+	}
+	entries := stream.entries[offset:end]
+	m.mu.Unlock()
+	return entries, Cursor(strconv.Itoa(end)), nil
+}
+
+func (m *MemorySource) Commit(destination, clientID string, cursor Cursor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.committed[destination+"/"+clientID] = cursor
+	return nil
+}
+
+func (m *MemorySource) Cursor(destination, clientID string) (Cursor, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.committed[destination+"/"+clientID], nil
+}
+
+func memoryOffset(cursor Cursor) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(string(cursor))
+}
@@ -0,0 +1,157 @@
+package canal
+
+import (
+	"time"
+
+	"github.com/katakurin/canal/protobuf/entry"
+)
+
+// Transaction groups the row changes committed together, as delimited by
+// TRANSACTIONBEGIN and TRANSACTIONEND entries. Row changes outside of any
+// transaction, such as most DDL statements, form a transaction of their own
+// without ThreadID nor ID.
+type Transaction struct {
+	// ThreadID is the MySQL thread that ran the transaction.
+	ThreadID int64
+	// ID is the XID of the transaction, from its TRANSACTIONEND entry.
+	ID string
+	// GTID is the global transaction ID, when GTID mode is on.
+	GTID string
+	// ExecuteTime is when the transaction started on the source.
+	ExecuteTime time.Time
+	// Events are the ROWDATA events of the transaction, in order.
+	Events []*Event
+	// Batches are the IDs of the batches the transaction spans.
+	Batches []int64
+}
+
+// RowChanges decodes the row changes of the transaction, in order.
+func (tx *Transaction) RowChanges() ([]*entry.RowChange, error) {
+	changes := make([]*entry.RowChange, 0, len(tx.Events))
+	for _, event := range tx.Events {
+		change, err := event.RowChange()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// TransactionAssembler stitches the entries of consecutive batches into
+// transactions, carrying a transaction that spans batches over from one to
+// the next. It tracks which batches may be acked: a batch that holds the
+// beginning of a transaction still open must not be acked before the
+// transaction is complete, or a restart would lose its first half.
+//
+// A TransactionAssembler is not safe for concurrent use.
+type TransactionAssembler struct {
+	current *Transaction
+	// pending are the batches fed but not ackable yet, ackable those that
+	// became ackable, in order.
+	pending []int64
+	ackable []int64
+}
+
+func NewTransactionAssembler() *TransactionAssembler {
+	return &TransactionAssembler{}
+}
+
+// Add feeds the next batch and returns the transactions it completed, in
+// order.
+func (a *TransactionAssembler) Add(message *Message) ([]*Transaction, error) {
+	if message.ID == -1 {
+		return nil, nil
+	}
+	events, err := message.Events()
+	if err != nil {
+		return nil, err
+	}
+	if a.current != nil {
+		a.current.Batches = append(a.current.Batches, message.ID)
+	}
+
+	var complete []*Transaction
+	for _, event := range events {
+		switch event.Type {
+		case entry.EntryType_TRANSACTIONBEGIN:
+			begin, err := event.TransactionBegin()
+			if err != nil {
+				return nil, err
+			}
+			// A begin without the end of the previous transaction means the
+			// end was lost; deliver what there is rather than merging them.
+			if a.current != nil {
+				complete = append(complete, a.current)
+			}
+			a.current = &Transaction{
+				ThreadID:    begin.GetThreadId(),
+				GTID:        event.Header.GetGtid(),
+				ExecuteTime: fromMillis(event.Header.GetExecuteTime()),
+				Batches:     []int64{message.ID},
+			}
+
+		case entry.EntryType_TRANSACTIONEND:
+			end, err := event.TransactionEnd()
+			if err != nil {
+				return nil, err
+			}
+			if a.current == nil {
+				// The beginning was acked before this assembler started.
+				continue
+			}
+			a.current.ID = end.GetTransactionId()
+			if a.current.GTID == "" {
+				a.current.GTID = event.Header.GetGtid()
+			}
+			complete = append(complete, a.current)
+			a.current = nil
+
+		case entry.EntryType_ROWDATA:
+			if a.current != nil {
+				a.current.Events = append(a.current.Events, event)
+				continue
+			}
+			complete = append(complete, &Transaction{
+				GTID:        event.Header.GetGtid(),
+				ExecuteTime: fromMillis(event.Header.GetExecuteTime()),
+				Events:      []*Event{event},
+				Batches:     []int64{message.ID},
+			})
+		}
+	}
+
+	a.pending = append(a.pending, message.ID)
+	open := 0
+	if a.current != nil {
+		// The batches the open transaction spans stay pending.
+		open = len(a.current.Batches)
+	}
+	a.ackable = append(a.ackable, a.pending[:len(a.pending)-open]...)
+	a.pending = append([]int64(nil), a.pending[len(a.pending)-open:]...)
+	return complete, nil
+}
+
+// Ackable returns the IDs of the batches every transaction of which was
+// returned by Add, in order, and forgets them. Ack them once those
+// transactions are handled.
+func (a *TransactionAssembler) Ackable() []int64 {
+	ackable := a.ackable
+	a.ackable = nil
+	return ackable
+}
+
+// Reset drops the open transaction and every batch not returned by Ackable
+// yet. Call it after rolling back, the server then delivers them again.
+func (a *TransactionAssembler) Reset() {
+	a.current = nil
+	a.pending = nil
+	a.ackable = nil
+}
+
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}